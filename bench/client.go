@@ -0,0 +1,420 @@
+package bench
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/packet"
+	"lingfliu.github.com/ucs_comm_test/stats"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+const DEFAULT_STATS_INTERVAL = 5 * time.Second
+
+type ClientConfig struct {
+	Proto string
+	Addr  string
+	Port  int
+	Fps   int
+	// PayloadSize pads every pingpong with that many bytes, CRC appends a checksum checked on both ends
+	PayloadSize int
+	CRC         bool
+	// StatsInterval logs the latency and jitter of every interval besides the one of the whole run, off if 0
+	StatsInterval time.Duration
+	// LossDeadline declares a pingpong not echoed within it lost, stats.DEFAULT_LOSS_DEADLINE if 0
+	LossDeadline time.Duration
+	// Reconnect keeps the client running across server restarts, dialing with Backoff
+	Reconnect bool
+	Backoff   conn.Backoff
+	// TLS runs tcp over TLS and ws as wss, quic always uses TLSOptions
+	TLS        bool
+	TLSOptions conn.TLSOptions
+	// ZeroRTT resumes quic sessions with 0-RTT, from the second connect on
+	ZeroRTT bool
+	// Datagram sends the pingpongs in unreliable quic DATAGRAM frames instead of a stream
+	Datagram bool
+	// Streams runs that many pingpongs on parallel streams of one quic connection
+	Streams int
+	TransportOptions
+	// Multicast sends the pingpongs to a multicast or broadcast group, answered by every responder
+	Multicast *conn.MulticastOptions
+}
+
+/**
+ * transport builds the conn options shared by every connect of the client
+ */
+func (cfg ClientConfig) transport() (transport, error) {
+	opts := cfg.base()
+	opts.zeroRTT = cfg.ZeroRTT
+	opts.datagram = cfg.Datagram
+	opts.multicast = cfg.Multicast
+	if !cfg.TLS && cfg.Proto != conn.PROTO_QUIC {
+		return opts, nil
+	}
+	tlsConfig, err := cfg.TLSOptions.ClientConfig()
+	if err != nil {
+		return opts, err
+	}
+	if cfg.ZeroRTT {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	opts.tls = tlsConfig
+	return opts, nil
+}
+
+/**
+ * RunClient connects to a pingpong server and measures the round trip latency until ctx is done
+ */
+func RunClient(ctx context.Context, cfg ClientConfig) error {
+	tag := cfg.Proto + "cli"
+	if cfg.Multicast != nil {
+		if cfg.Reconnect || cfg.Streams > 1 {
+			return errors.New("reconnect and multiple streams are not supported with multicast")
+		}
+		return runMulticastClient(ctx, cfg, tag)
+	}
+	if cfg.Reconnect {
+		if cfg.Streams > 1 {
+			return errors.New("multiple streams are not supported with reconnect")
+		}
+		return runReconnClient(ctx, cfg, tag)
+	}
+
+	opts, err := cfg.transport()
+	if err != nil {
+		return err
+	}
+	c, err := newConn(cfg.Proto, cfg.Addr, cfg.Port, opts)
+	if err != nil {
+		return err
+	}
+	logConfig(tag, cfg.Proto, opts)
+
+	start := time.Now()
+	err = c.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	defer c.Close()
+
+	// the connect time includes the tls / quic handshake
+	ulog.Log().I(tag, fmt.Sprintf("connected to %s in %d us", c.RemoteAddr(), time.Since(start).Microseconds()))
+	logSocketInfo(tag, c)
+
+	conns := []conn.ConnOp{c}
+	if cfg.Streams > 1 {
+		q, ok := c.(*conn.QuicConn)
+		if !ok {
+			return fmt.Errorf("multiple streams are not supported over %s", cfg.Proto)
+		}
+		for i := 1; i < cfg.Streams; i++ {
+			s, err := q.OpenStream(ctx)
+			if err != nil {
+				return fmt.Errorf("open stream failed: %w", err)
+			}
+			defer s.Close()
+			conns = append(conns, s)
+		}
+	}
+
+	// every stream runs its own pingpong, the client stops once one of them is lost
+	lost := make(chan conn.ConnOp, len(conns))
+	for i, c := range conns {
+		stag := tag
+		if len(conns) > 1 {
+			stag = fmt.Sprintf("%s#%d", tag, i)
+		}
+		s, err := startPingpong(ctx, stag, c, cfg)
+		if err != nil {
+			return err
+		}
+		defer s.report(stag)
+		go func(c conn.ConnOp) {
+			<-c.Done()
+			lost <- c
+		}(c)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case c := <-lost:
+		return fmt.Errorf("connection lost: %w", c.Err())
+	}
+}
+
+/**
+ * startPingpong starts the pingpong tasks on a connected conn
+ */
+func startPingpong(ctx context.Context, tag string, c conn.ConnOp, cfg ClientConfig) (*pingpongStats, error) {
+	ulog.Log().I(tag, fmt.Sprintf("start pingpong at fps = %d", cfg.Fps))
+	tx := make(chan *conn.Buffer)
+	rx := make(chan *conn.Buffer)
+
+	if err := c.StartRecv(ctx, rx); err != nil {
+		return nil, err
+	}
+	if err := c.StartWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	s := newPingpongStats(cfg.LossDeadline)
+	go _task_handle_recv(tag, rx, s, nil)
+	go _task_write_pingpong(ctx, tag, tx, cfg.Fps, cfg.format(), s.seq.Sent, nil)
+	go _task_report_interval(ctx, tag, s, cfg.StatsInterval)
+	return s, nil
+}
+
+/**
+ * outage records how long the client was cut off from the server: from losing the conn
+ * until the first pingpong comes back, a reconnect that delivers nothing does not end it
+ */
+type outage struct {
+	connected atomic.Bool
+
+	mu           sync.Mutex
+	connectingAt time.Time
+	lostAt       time.Time
+	count        int
+	total        time.Duration
+	max          time.Duration
+}
+
+func (o *outage) onStateChange(tag string, state int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch state {
+	case conn.STATE_CONNECTING:
+		o.connectingAt = time.Now()
+	case conn.STATE_CONNECTED:
+		ulog.Log().I(tag, fmt.Sprintf("connected in %d us", time.Since(o.connectingAt).Microseconds()))
+		o.connected.Store(true)
+	case conn.STATE_DISCONNECTED:
+		o.connected.Store(false)
+		if o.lostAt.IsZero() {
+			o.lostAt = time.Now()
+		}
+		ulog.Log().I(tag, fmt.Sprintf("connection lost: %v, reconnecting", err))
+	case conn.STATE_CLOSED:
+		o.connected.Store(false)
+	}
+}
+
+/**
+ * onRecv ends a running outage, called for every pingpong received
+ */
+func (o *outage) onRecv(tag string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.lostAt.IsZero() {
+		return
+	}
+	d := time.Since(o.lostAt)
+	o.count++
+	o.total += d
+	if d > o.max {
+		o.max = d
+	}
+	o.lostAt = time.Time{}
+	ulog.Log().I(tag, fmt.Sprintf("pingpong back after an outage of %d ms", d.Milliseconds()))
+}
+
+func runReconnClient(ctx context.Context, cfg ClientConfig, tag string) error {
+	opts, err := cfg.transport()
+	if err != nil {
+		return err
+	}
+	// the first conn checks the options up front and serves the first dial, the options cannot fail later
+	first, err := newConn(cfg.Proto, cfg.Addr, cfg.Port, opts)
+	if err != nil {
+		return err
+	}
+	logConfig(tag, cfg.Proto, opts)
+	r := conn.NewReconnConn(func() conn.ConnOp {
+		if c := first; c != nil {
+			first = nil
+			return c
+		}
+		c, _ := newConn(cfg.Proto, cfg.Addr, cfg.Port, opts)
+		return c
+	}, cfg.Backoff)
+
+	o := &outage{}
+	r.OnStateChange = func(state int, err error) {
+		o.onStateChange(tag, state, err)
+	}
+
+	ulog.Log().I(tag, fmt.Sprintf("start pingpong at fps = %d with reconnect", cfg.Fps))
+	tx := make(chan *conn.Buffer)
+	rx := make(chan *conn.Buffer)
+
+	s := newPingpongStats(cfg.LossDeadline)
+	defer s.report(tag)
+	go _task_handle_recv(tag, rx, s, func() { o.onRecv(tag) })
+	go _task_write_pingpong(ctx, tag, tx, cfg.Fps, cfg.format(), s.seq.Sent, o.connected.Load)
+	go _task_report_interval(ctx, tag, s, cfg.StatsInterval)
+
+	err = r.Run(ctx, rx, tx)
+	o.mu.Lock()
+	ulog.Log().I(tag, fmt.Sprintf("outages = %d, total outage = %d ms, max outage = %d ms",
+		o.count, o.total.Milliseconds(), o.max.Milliseconds()))
+	o.mu.Unlock()
+	return err
+}
+
+func (cfg ClientConfig) format() pingpongFormat {
+	f := pingpongFormat{payload: make([]byte, cfg.PayloadSize)}
+	if cfg.CRC {
+		f.flags |= packet.FLAG_CRC
+	}
+	return f
+}
+
+/**
+ * pingpongStats is what a client measures of one pingpong flow
+ */
+type pingpongStats struct {
+	seq     *stats.SeqTracker
+	latency *stats.Recorder
+	jitter  *stats.Jitter
+	oneway  *stats.OneWay
+	// echoes failing the packet checks
+	rejected atomic.Uint64
+}
+
+func newPingpongStats(deadline time.Duration) *pingpongStats {
+	return &pingpongStats{
+		seq:     stats.NewSeqTracker(deadline),
+		latency: stats.NewRecorder(),
+		jitter:  stats.NewJitter(),
+		oneway:  stats.NewOneWay(),
+	}
+}
+
+/**
+ * logOneWay logs the one way delays, if the server stamped any pingpong
+ */
+func logOneWay(tag string, r stats.OneWayReport, what string) {
+	if r.Processing.Count == 0 {
+		return
+	}
+	ulog.Log().I(tag, fmt.Sprintf("clock offset%s: %s", what, r.OffsetString()))
+	ulog.Log().I(tag, fmt.Sprintf("uplink%s: %s", what, r.Uplink))
+	ulog.Log().I(tag, fmt.Sprintf("downlink%s: %s", what, r.Downlink))
+	ulog.Log().I(tag, fmt.Sprintf("server processing%s: %s", what, r.Processing))
+}
+
+func (s *pingpongStats) report(tag string) {
+	ulog.Log().I(tag, "packets: "+s.seq.Report(time.Now()).String())
+	ulog.Log().I(tag, "latency: "+s.latency.Total().String())
+	ulog.Log().I(tag, "jitter: "+s.jitter.Total().String())
+	logOneWay(tag, s.oneway.Total(), "")
+	if n := s.rejected.Load(); n > 0 {
+		ulog.Log().I(tag, fmt.Sprintf("rejected = %d malformed packets", n))
+	}
+}
+
+/**
+ * _task_report_interval logs the latency, jitter and one way delays of every interval until ctx is done
+ */
+func _task_report_interval(ctx context.Context, tag string, s *pingpongStats, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	tic := time.NewTicker(interval)
+	defer tic.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tic.C:
+			ulog.Log().I(tag, fmt.Sprintf("latency of the last %d s: %s", int(interval.Seconds()), s.latency.Interval()))
+			ulog.Log().I(tag, fmt.Sprintf("jitter of the last %d s: %s", int(interval.Seconds()), s.jitter.Interval()))
+			logOneWay(tag, s.oneway.Interval(), fmt.Sprintf(" of the last %d s", int(interval.Seconds())))
+			ulog.Log().I(tag, "packets so far: "+s.seq.Report(time.Now()).String())
+		}
+	}
+}
+
+func _task_handle_recv(tag string, rx chan *conn.Buffer, s *pingpongStats, onRecv func()) {
+	for rx_buff := range rx {
+		toc := utils.CurrentTimeInNano()
+		p, err := packet.Decode(rx_buff.Bytes())
+		if err == nil && p.Type != packet.TYPE_PINGPONG {
+			err = fmt.Errorf("%w: %d", packet.ErrType, p.Type)
+		}
+		rx_buff.Release()
+		if err != nil {
+			s.rejected.Add(1)
+			ulog.Log().I(tag, "rejected malformed packet: "+err.Error())
+			continue
+		}
+		if onRecv != nil {
+			onRecv()
+		}
+		idx := p.Seq
+		latency := toc - p.ClientSend
+		outcome := s.seq.Recv(idx, time.Now())
+		switch outcome {
+		case stats.SEQ_DUPLICATE, stats.SEQ_UNKNOWN:
+			// only the first arrival of a sent pingpong has a latency
+			ulog.Log().I(tag, fmt.Sprintf("recv pingpong idx = %d, %s", idx, stats.SeqOutcomeName(outcome)))
+			continue
+		case stats.SEQ_IN_ORDER:
+			ulog.Log().I(tag, fmt.Sprintf("recv pingpong idx = %d, latency = %d", idx, latency))
+		default:
+			ulog.Log().I(tag, fmt.Sprintf("recv pingpong idx = %d, latency = %d, %s", idx, latency, stats.SeqOutcomeName(outcome)))
+		}
+		s.latency.Record(time.Duration(latency))
+		s.jitter.Record(time.Duration(latency))
+		if p.Stamped() {
+			s.oneway.Record(p.ClientSend, p.ServerRecv, p.ServerSend, toc)
+		}
+	}
+	ulog.Log().I(tag, "receive channel closed")
+}
+
+/**
+ * _task_write_pingpong sends a pingpong every 1/fps second, registering it with sent first if not nil.
+ * While ready reports false the ticks are skipped, so the sequence resumes where it stopped once the conn is back.
+ */
+func _task_write_pingpong(ctx context.Context, tag string, tx chan *conn.Buffer, fps int, f pingpongFormat, sent func(idx uint64, at time.Time), ready func() bool) {
+	idx := uint64(0)
+	paused := false
+	tic := time.NewTicker(time.Second / time.Duration(fps))
+	defer tic.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tic.C:
+			if ready != nil && !ready() {
+				paused = true
+				continue
+			}
+			if paused {
+				paused = false
+				ulog.Log().I(tag, fmt.Sprintf("resume pingpong at idx = %d", idx+1))
+			}
+			idx++
+			// registered before the echo can possibly come back
+			now := time.Now()
+			if sent != nil {
+				sent(idx, now)
+			}
+			select {
+			case tx <- conn.WrapBuffer(f.encode(idx, now.UnixNano())):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package bench
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/stats"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+const DEFAULT_HANDSHAKE_COUNT = 50
+const HANDSHAKE_TIMEOUT = 5 * time.Second
+
+var errNoEcho = errors.New("no echo before the timeout")
+
+type HandshakeConfig struct {
+	Addr  string
+	Port  int
+	Count int
+	// Interval is the pause between two connects
+	Interval   time.Duration
+	TLSOptions conn.TLSOptions
+	TransportOptions
+}
+
+/**
+ * handshakeSeries collects the timings of the connects of one mode
+ */
+type handshakeSeries struct {
+	mode string
+	// firstEcho runs from the dial to the echo of the first pingpong, what 0-RTT actually saves
+	firstEcho *stats.Histogram
+	// handshake runs from the dial to the completed handshake, in both modes, though a 0-RTT connect returns before it
+	handshake *stats.Histogram
+	used0RTT  int
+	failed    int
+}
+
+func newHandshakeSeries(mode string) *handshakeSeries {
+	return &handshakeSeries{mode: mode, firstEcho: stats.NewHistogram(), handshake: stats.NewHistogram()}
+}
+
+/**
+ * RunHandshake reconnects to a quic pingpong server Count times with full 1-RTT handshakes
+ * and Count times resuming with 0-RTT, then reports both latency distributions.
+ * 0-RTT needs a server started with zero_rtt.
+ */
+func RunHandshake(ctx context.Context, cfg HandshakeConfig) error {
+	tag := "handshake"
+	if cfg.Count <= 0 {
+		cfg.Count = DEFAULT_HANDSHAKE_COUNT
+	}
+
+	logConfig(tag, conn.PROTO_QUIC, cfg.base())
+
+	full := newHandshakeSeries("1-rtt")
+	for i := 0; i < cfg.Count && ctx.Err() == nil; i++ {
+		// a fresh config has no session ticket to resume
+		tlsConfig, err := cfg.TLSOptions.ClientConfig()
+		if err != nil {
+			return err
+		}
+		opts := cfg.base()
+		opts.tls = tlsConfig
+		full.run(ctx, tag, cfg, opts)
+	}
+
+	tlsConfig, err := cfg.TLSOptions.ClientConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	opts := cfg.base()
+	opts.tls = tlsConfig
+	opts.zeroRTT = true
+	// the first connect only fetches the session ticket
+	warmup := newHandshakeSeries("0-rtt warmup")
+	warmup.run(ctx, tag, cfg, opts)
+	early := newHandshakeSeries("0-rtt")
+	for i := 0; i < cfg.Count && ctx.Err() == nil; i++ {
+		early.run(ctx, tag, cfg, opts)
+	}
+
+	for _, s := range []*handshakeSeries{full, early} {
+		ulog.Log().I(tag, fmt.Sprintf("%s: %d connects, %d failed, %d used 0-rtt", s.mode, s.firstEcho.Count(), s.failed, s.used0RTT))
+		ulog.Log().I(tag, fmt.Sprintf("%s first echo: %s", s.mode, s.firstEcho.Summary()))
+		ulog.Log().I(tag, fmt.Sprintf("%s handshake: %s", s.mode, s.handshake.Summary()))
+	}
+	if early.firstEcho.Count() > 0 && early.used0RTT == 0 {
+		ulog.Log().I(tag, "the server accepted no 0-rtt, is it running with zero_rtt?")
+	}
+	return nil
+}
+
+func (s *handshakeSeries) run(ctx context.Context, tag string, cfg HandshakeConfig, opts transport) {
+	handshake, firstEcho, used0RTT, err := handshakeOnce(ctx, cfg, opts)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.failed++
+			ulog.Log().I(tag, fmt.Sprintf("%s connect failed: %v", s.mode, err))
+		}
+		return
+	}
+	s.firstEcho.Record(firstEcho)
+	s.handshake.Record(handshake)
+	if used0RTT {
+		s.used0RTT++
+	}
+	ulog.Log().I(tag, fmt.Sprintf("%s first echo = %d us, handshake = %d us, 0-rtt = %t",
+		s.mode, firstEcho.Microseconds(), handshake.Microseconds(), used0RTT))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(cfg.Interval):
+	}
+}
+
+/**
+ * handshakeOnce connects, sends one pingpong and waits for its echo, returning the handshake and first echo times
+ */
+func handshakeOnce(ctx context.Context, cfg HandshakeConfig, opts transport) (time.Duration, time.Duration, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	c, err := newConn(conn.PROTO_QUIC, cfg.Addr, cfg.Port, opts)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer c.Close()
+
+	start := time.Now()
+	if err = c.Connect(ctx); err != nil {
+		return 0, 0, false, err
+	}
+	// a 0-RTT connect returns before the handshake, which then completes next to the first pingpong
+	type result struct {
+		at   time.Duration
+		used bool
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		used, err := c.(*conn.QuicConn).WaitHandshake(ctx)
+		done <- result{time.Since(start), used, err}
+	}()
+
+	rx := make(chan *conn.Buffer)
+	if err = c.StartRecv(ctx, rx); err != nil {
+		return 0, 0, false, err
+	}
+	if err = c.InstantWrite(pingpongFormat{}.encode(1, utils.CurrentTimeInNano())); err != nil {
+		return 0, 0, false, err
+	}
+	buff, ok := <-rx
+	if !ok {
+		if ctx.Err() != nil {
+			return 0, 0, false, errNoEcho
+		}
+		return 0, 0, false, c.Err()
+	}
+	buff.Release()
+	firstEcho := time.Since(start)
+
+	hs := <-done
+	if hs.err != nil {
+		return 0, 0, false, hs.err
+	}
+	return hs.at, firstEcho, hs.used, nil
+}
@@ -0,0 +1,290 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/packet"
+	"lingfliu.github.com/ucs_comm_test/stats"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+const DEFAULT_BULK_SIZE = 64 << 10
+const DEFAULT_BULK_RATE = 200
+
+// where the bulk flow runs relative to the pingpong
+const BULK_NONE = "none"
+const BULK_SHARED = "shared"
+const BULK_STREAM = "stream"
+const BULK_CONN = "conn"
+
+type holScenario struct {
+	name  string
+	proto string
+	bulk  string
+}
+
+var holScenarios = []holScenario{
+	{"tcp-base", conn.PROTO_TCP, BULK_NONE},
+	{"tcp-shared", conn.PROTO_TCP, BULK_SHARED},
+	{"tcp-conns", conn.PROTO_TCP, BULK_CONN},
+	{"quic-base", conn.PROTO_QUIC, BULK_NONE},
+	{"quic-streams", conn.PROTO_QUIC, BULK_STREAM},
+	{"quic-conns", conn.PROTO_QUIC, BULK_CONN},
+}
+
+/**
+ * HolScenarioNames lists the scenarios of the head-of-line blocking benchmark
+ */
+func HolScenarioNames() []string {
+	names := make([]string, len(holScenarios))
+	for i, sc := range holScenarios {
+		names[i] = sc.name
+	}
+	return names
+}
+
+type HolConfig struct {
+	Addr     string
+	TcpPort  int
+	QuicPort int
+	Fps      int
+	// Duration of each scenario
+	Duration time.Duration
+	// BulkSize is the size of a bulk message, BulkRate the bulk messages per second, 0 for as fast as possible
+	BulkSize int
+	BulkRate int
+	// Scenarios to run, all if empty
+	Scenarios []string
+	// TLS runs the tcp scenarios over TLS
+	TLS        bool
+	TLSOptions conn.TLSOptions
+	TransportOptions
+}
+
+/**
+ * holResult collects what one scenario measured
+ */
+type holResult struct {
+	name      string
+	mu        sync.Mutex
+	latency   *stats.Histogram
+	bulkBytes atomic.Int64
+	elapsed   time.Duration
+}
+
+func (r *holResult) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mbps := float64(r.bulkBytes.Load()) / r.elapsed.Seconds() / (1 << 20)
+	return fmt.Sprintf("%s: bulk = %.2f MB/s, pingpong %s", r.name, mbps, r.latency.Summary())
+}
+
+/**
+ * RunHol runs the pingpong of a tcp and a quic pingpong server alone and next to a bulk flow: on the
+ * same tcp connection, on another stream of the quic connection and on a connection of its own,
+ * then reports how the pingpong latency degrades in each case
+ */
+func RunHol(ctx context.Context, cfg HolConfig) error {
+	tag := "hol"
+	if cfg.BulkSize < packet.HEADER_LEN {
+		return fmt.Errorf("bulk size must be at least %d", packet.HEADER_LEN)
+	}
+	scenarios := holScenarios
+	if len(cfg.Scenarios) > 0 {
+		scenarios = nil
+		for _, name := range cfg.Scenarios {
+			found := false
+			for _, sc := range holScenarios {
+				if sc.name == name {
+					scenarios = append(scenarios, sc)
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("unknown scenario: %s, one of %s", name, strings.Join(HolScenarioNames(), ", "))
+			}
+		}
+	}
+
+	results := []*holResult{}
+	for _, sc := range scenarios {
+		if ctx.Err() != nil {
+			break
+		}
+		ulog.Log().I(tag, fmt.Sprintf("run %s for %d s", sc.name, int(cfg.Duration.Seconds())))
+		r, err := runHolScenario(ctx, tag, cfg, sc)
+		if err != nil {
+			ulog.Log().I(tag, fmt.Sprintf("%s failed: %v", sc.name, err))
+			continue
+		}
+		ulog.Log().I(tag, r.String())
+		results = append(results, r)
+		// let the server drop the sessions of the scenario, a cancel stops at the top of the loop and still logs the summary
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	ulog.Log().I(tag, "summary:")
+	for _, r := range results {
+		ulog.Log().I(tag, r.String())
+	}
+	return nil
+}
+
+func runHolScenario(ctx context.Context, tag string, cfg HolConfig, sc holScenario) (*holResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	port := cfg.TcpPort
+	opts := cfg.base()
+	if sc.proto == conn.PROTO_QUIC {
+		port = cfg.QuicPort
+	}
+	if cfg.TLS || sc.proto == conn.PROTO_QUIC {
+		tlsConfig, err := cfg.TLSOptions.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.tls = tlsConfig
+	}
+	dial := func() (conn.ConnOp, error) {
+		c, err := newConn(sc.proto, cfg.Addr, port, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.Connect(ctx); err != nil {
+			return nil, fmt.Errorf("connect failed: %w", err)
+		}
+		return c, nil
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	logConfig(tag, sc.proto, opts)
+	logSocketInfo(tag, c)
+
+	var bulk conn.ConnOp
+	switch sc.bulk {
+	case BULK_STREAM:
+		s, err := c.(*conn.QuicConn).OpenStream(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("open stream failed: %w", err)
+		}
+		bulk = s
+	case BULK_CONN:
+		bulk, err = dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bulk != nil {
+		defer bulk.Close()
+	}
+
+	r := &holResult{name: sc.name, latency: stats.NewHistogram()}
+	tx, err := startHolConn(ctx, c, r)
+	if err != nil {
+		return nil, err
+	}
+	bulkTx := tx
+	if bulk != nil {
+		if bulkTx, err = startHolConn(ctx, bulk, r); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	go _task_write_pingpong(ctx, tag, tx, cfg.Fps, pingpongFormat{}, nil, nil)
+	if sc.bulk != BULK_NONE {
+		go _task_write_bulk(ctx, bulkTx, cfg.BulkSize, cfg.BulkRate)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(cfg.Duration):
+	case <-c.Done():
+		return nil, fmt.Errorf("connection lost: %w", c.Err())
+	}
+	r.elapsed = time.Since(start)
+	return r, nil
+}
+
+/**
+ * startHolConn starts the tasks of a scenario conn and returns its tx
+ */
+func startHolConn(ctx context.Context, c conn.ConnOp, r *holResult) (chan *conn.Buffer, error) {
+	tx := make(chan *conn.Buffer)
+	rx := make(chan *conn.Buffer)
+	if err := c.StartRecv(ctx, rx); err != nil {
+		return nil, err
+	}
+	if err := c.StartWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+	go _task_hol_recv(rx, r)
+	return tx, nil
+}
+
+/**
+ * _task_hol_recv records the pingpong latencies and counts the bulk bytes, told apart by their type
+ */
+func _task_hol_recv(rx chan *conn.Buffer, r *holResult) {
+	for rx_buff := range rx {
+		toc := utils.CurrentTimeInNano()
+		p, err := packet.Decode(rx_buff.Bytes())
+		rx_buff.Release()
+		if err != nil {
+			ulog.Log().I("hol", "rejected malformed packet: "+err.Error())
+			continue
+		}
+		if p.Type == packet.TYPE_BULK {
+			r.bulkBytes.Add(int64(p.Len()))
+			continue
+		}
+		latency := time.Duration(toc - p.ClientSend)
+		r.mu.Lock()
+		r.latency.Record(latency)
+		r.mu.Unlock()
+	}
+}
+
+/**
+ * _task_write_bulk sends bulk messages of size bytes at rate per second, or as fast as tx takes them if rate is 0
+ */
+func _task_write_bulk(ctx context.Context, tx chan *conn.Buffer, size int, rate int) {
+	// the write task only reads the packet, so every message shares it
+	bulk := packet.Packet{Type: packet.TYPE_BULK, Payload: make([]byte, size-packet.HEADER_LEN)}
+	payload := bulk.Encode()
+	var tic <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tic = ticker.C
+	}
+	for {
+		if tic != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tic:
+			}
+		}
+		select {
+		case tx <- conn.WrapBuffer(payload):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
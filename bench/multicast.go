@@ -0,0 +1,148 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/stats"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+/**
+ * responder is a peer answering the pingpongs of a multicast client
+ */
+type responder struct {
+	tag string
+	s   *pingpongStats
+}
+
+type sentAt struct {
+	idx uint64
+	at  time.Time
+}
+
+/**
+ * groupSent registers every pingpong sent to the group with the tracker of each responder. It keeps
+ * the pingpongs sent within the loss deadline, a new responder is answering one of them.
+ */
+type groupSent struct {
+	mu       sync.Mutex
+	deadline time.Duration
+	count    uint64
+	recent   []sentAt
+	trackers []*stats.SeqTracker
+}
+
+func (g *groupSent) sent(idx uint64, at time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.count++
+	drop := 0
+	for drop < len(g.recent) && at.Sub(g.recent[drop].at) > g.deadline {
+		drop++
+	}
+	g.recent = append(g.recent[drop:], sentAt{idx, at})
+	for _, t := range g.trackers {
+		t.Sent(idx, at)
+	}
+}
+
+/**
+ * join tracks a new responder from the recent pingpongs on, the first reply drops the older ones
+ */
+func (g *groupSent) join(t *stats.SeqTracker) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t.JoinLate = true
+	for _, s := range g.recent {
+		t.Sent(s.idx, s.at)
+	}
+	g.trackers = append(g.trackers, t)
+}
+
+func (g *groupSent) total() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.count
+}
+
+/**
+ * runMulticastClient sends every pingpong to the group once and tracks the replies of each responder
+ * on its own, reporting the latency and loss of every responder
+ */
+func runMulticastClient(ctx context.Context, cfg ClientConfig, tag string) error {
+	opts, err := cfg.transport()
+	if err != nil {
+		return err
+	}
+	c, err := newConn(cfg.Proto, cfg.Addr, cfg.Port, opts)
+	if err != nil {
+		return err
+	}
+	logConfig(tag, cfg.Proto, opts)
+	if err = c.Connect(ctx); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	defer c.Close()
+	u := c.(*conn.UdpConn)
+
+	ulog.Log().I(tag, fmt.Sprintf("start pingpong to group %s at fps = %d", c.RemoteAddr(), cfg.Fps))
+	tx := make(chan *conn.Buffer)
+	if err = c.StartWrite(ctx, tx); err != nil {
+		return err
+	}
+	deadline := cfg.LossDeadline
+	if deadline <= 0 {
+		deadline = stats.DEFAULT_LOSS_DEADLINE
+	}
+	group := &groupSent{deadline: deadline}
+	go _task_write_pingpong(ctx, tag, tx, cfg.Fps, cfg.format(), group.sent, nil)
+
+	responders := map[string]*responder{}
+	newC := make(chan conn.ConnOp)
+	go u.Responders(ctx, newC)
+	for p := range newC {
+		// a responder evicted for idling comes back as a new peer, its tracker counted the gap as lost
+		r, back := responders[p.RemoteAddr()]
+		if back {
+			ulog.Log().I(tag, "responder back "+p.RemoteAddr())
+		} else {
+			r = &responder{
+				tag: tag + "@" + p.RemoteAddr(),
+				s:   newPingpongStats(deadline),
+			}
+			ulog.Log().I(tag, "new responder "+p.RemoteAddr())
+		}
+		rx := make(chan *conn.Buffer)
+		if err := p.StartRecv(ctx, rx); err != nil {
+			p.Close()
+			continue
+		}
+		if !back {
+			group.join(r.s.seq)
+			responders[p.RemoteAddr()] = r
+			go _task_report_interval(ctx, r.tag, r.s, cfg.StatsInterval)
+		}
+		go _task_handle_recv(r.tag, rx, r.s, nil)
+	}
+
+	ulog.Log().I(tag, fmt.Sprintf("sent = %d", group.total()))
+	addrs := make([]string, 0, len(responders))
+	for addr := range responders {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		r := responders[addr]
+		r.s.report(r.tag)
+	}
+	ulog.Log().I(tag, fmt.Sprintf("responders = %d", len(responders)))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("connection lost: %w", c.Err())
+}
@@ -0,0 +1,54 @@
+package bench
+
+import (
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/packet"
+)
+
+const DEFAULT_PORT_TCP = 10071
+const DEFAULT_PORT_UDP = 10072
+const DEFAULT_PORT_WS = 10073
+const DEFAULT_PORT_QUIC = 10074
+
+// the unix protocols only name their socket file after the port
+const DEFAULT_PORT_UNIX = 10075
+const DEFAULT_PORT_UNIXGRAM = 10076
+
+/**
+ * pingpongFormat is what every pingpong of a client carries besides the packet header
+ */
+type pingpongFormat struct {
+	payload []byte
+	flags   uint16
+}
+
+func (f pingpongFormat) encode(idx uint64, tic int64) []byte {
+	p := packet.Packet{
+		Type:       packet.TYPE_PINGPONG,
+		Flags:      f.flags,
+		Seq:        idx,
+		ClientSend: tic,
+		Payload:    f.payload,
+	}
+	return p.Encode()
+}
+
+/**
+ * DefaultPort returns the port the mock programs used for each protocol
+ */
+func DefaultPort(proto string) int {
+	switch proto {
+	case conn.PROTO_UDP:
+		return DEFAULT_PORT_UDP
+	case conn.PROTO_QUIC:
+		return DEFAULT_PORT_QUIC
+	case conn.PROTO_WS:
+		return DEFAULT_PORT_WS
+	case conn.PROTO_UNIX:
+		return DEFAULT_PORT_UNIX
+	case conn.PROTO_UNIXGRAM:
+		return DEFAULT_PORT_UNIXGRAM
+	default:
+		return DEFAULT_PORT_TCP
+	}
+}
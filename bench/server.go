@@ -0,0 +1,142 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/packet"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+const DEFAULT_IDLE_TIMEOUT = 10 * time.Second
+
+type ServerConfig struct {
+	Proto       string
+	Addr        string
+	Port        int
+	IdleTimeout time.Duration
+	// PeerQueueSize bounds the datagrams queued per udp client
+	PeerQueueSize int
+	// TLS runs tcp over TLS and ws as wss, quic always uses TLSOptions
+	TLS        bool
+	TLSOptions conn.TLSOptions
+	// ZeroRTT accepts 0-RTT data of resuming quic clients
+	ZeroRTT bool
+	// Datagram echoes quic DATAGRAM frames instead of a stream
+	Datagram bool
+	TransportOptions
+	// Multicast makes the udp server a responder of a multicast or broadcast group
+	Multicast *conn.MulticastOptions
+}
+
+func (cfg ServerConfig) transport() (transport, error) {
+	opts := cfg.base()
+	opts.zeroRTT = cfg.ZeroRTT
+	opts.datagram = cfg.Datagram
+	opts.multicast = cfg.Multicast
+	if !cfg.TLS && cfg.Proto != conn.PROTO_QUIC {
+		return opts, nil
+	}
+	tlsConfig, err := cfg.TLSOptions.ServerConfig()
+	if err != nil {
+		return opts, err
+	}
+	opts.tls = tlsConfig
+	return opts, nil
+}
+
+/**
+ * RunServer accepts pingpong clients and echoes back everything they send until ctx is done
+ */
+func RunServer(ctx context.Context, cfg ServerConfig) error {
+	tag := cfg.Proto + "_srv"
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DEFAULT_IDLE_TIMEOUT
+	}
+
+	opts, err := cfg.transport()
+	if err != nil {
+		return err
+	}
+	srvConn, err := newConn(cfg.Proto, cfg.Addr, cfg.Port, opts)
+	if err != nil {
+		return err
+	}
+	logConfig(tag, cfg.Proto, opts)
+	if u, ok := srvConn.(*conn.UdpConn); ok {
+		if cfg.PeerQueueSize > 0 {
+			u.PeerQueueSize = cfg.PeerQueueSize
+		}
+		// the session manager expires idle peers, like the conns of every other protocol
+		u.PeerIdleTimeout = 0
+	}
+
+	m := conn.NewSessionManager(cfg.IdleTimeout)
+	m.OnConnect = func(s *conn.Session) {
+		ulog.Log().I(tag, fmt.Sprintf("new client connected from %s, sessions = %d", s.C.RemoteAddr(), m.Count()))
+	}
+	m.OnDisconnect = func(s *conn.Session, err error) {
+		ulog.Log().I(tag, fmt.Sprintf("client %s disconnected: %v, sessions = %d", s.C.RemoteAddr(), err, m.Count()))
+		if u, ok := s.C.(*conn.UdpConn); ok && u.Drops() > 0 {
+			ulog.Log().I(tag, fmt.Sprintf("client %s dropped %d datagrams on a full queue", s.C.RemoteAddr(), u.Drops()))
+		}
+	}
+
+	where := fmt.Sprintf("port %d", cfg.Port)
+	if cfg.Proto == conn.PROTO_UNIX || cfg.Proto == conn.PROTO_UNIXGRAM {
+		where = srvConn.RemoteAddr()
+	}
+	ulog.Log().I(tag, "starting listening at "+where)
+	err = m.Serve(ctx, srvConn, func(ctx context.Context, s *conn.Session) {
+		_task_echo(ctx, tag, s.C)
+	})
+	if ctx.Err() != nil {
+		ulog.Log().I(tag, "stopping server")
+		return nil
+	}
+	return err
+}
+
+/**
+ * A pingpong task that will send the received data back to the client.
+ * The rx buffer is handed to the write task as is, which releases it after writing.
+ * A pingpong is stamped with the receive time and the time it is handed to the write task,
+ * a bulk packet is echoed untouched and a malformed one dropped.
+ */
+func _task_echo(ctx context.Context, tag string, c conn.ConnOp) {
+	tx := make(chan *conn.Buffer)
+	rx := make(chan *conn.Buffer)
+
+	if err := c.StartRecv(ctx, rx); err != nil {
+		ulog.Log().I(tag, "start recv failed: "+err.Error())
+		c.Close()
+		return
+	}
+	if err := c.StartWrite(ctx, tx); err != nil {
+		ulog.Log().I(tag, "start write failed: "+err.Error())
+		c.Close()
+		return
+	}
+
+	for rx_buff := range rx {
+		recv := utils.CurrentTimeInNano()
+		ulog.Log().I(tag, fmt.Sprintf("received %d bytes, echoing back", rx_buff.Len()))
+		p, err := packet.Decode(rx_buff.Bytes())
+		if err != nil {
+			ulog.Log().I(tag, "rejected malformed packet: "+err.Error())
+			rx_buff.Release()
+			continue
+		}
+		if p.Type == packet.TYPE_PINGPONG {
+			packet.Stamp(rx_buff.Bytes(), recv, utils.CurrentTimeInNano())
+		}
+		select {
+		case tx <- rx_buff:
+		case <-c.Done():
+			rx_buff.Release()
+		}
+	}
+}
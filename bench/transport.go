@@ -0,0 +1,104 @@
+package bench
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+/**
+ * TransportOptions tunes the transports of a command, embedded in its config.
+ * Tcp sets the socket options of tcp and Quic tunes quic, the go and quic-go defaults where nil.
+ */
+type TransportOptions struct {
+	Tcp  *conn.TcpOptions
+	Quic *quic.Config
+}
+
+func (o TransportOptions) base() transport {
+	return transport{tcp: o.Tcp, quic: o.Quic}
+}
+
+/**
+ * transport holds the options of a conn that only some protocols support
+ */
+type transport struct {
+	tls      *tls.Config
+	tcp      *conn.TcpOptions
+	quic     *quic.Config
+	zeroRTT  bool
+	datagram bool
+	// multicast makes a udp conn one-to-many
+	multicast *conn.MulticastOptions
+}
+
+/**
+ * newConn creates the conn of proto and applies the transport options
+ */
+func newConn(proto string, addr string, port int, opts transport) (conn.ConnOp, error) {
+	c, err := conn.NewConn(proto, addr, port)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := c.(*conn.TcpConn); ok && opts.tcp != nil {
+		t.Options = *opts.tcp
+	}
+	if q, ok := c.(*conn.QuicConn); ok {
+		q.Config = opts.quic
+		q.ZeroRTT = opts.zeroRTT
+		q.Datagram = opts.datagram
+	} else if opts.zeroRTT || opts.datagram {
+		return nil, fmt.Errorf("0-rtt and datagrams are not supported over %s", proto)
+	}
+	if opts.multicast != nil {
+		if proto != conn.PROTO_UDP {
+			return nil, fmt.Errorf("multicast is not supported over %s", proto)
+		}
+		c.(*conn.UdpConn).Multicast = opts.multicast
+	}
+	if opts.tls != nil {
+		switch t := c.(type) {
+		case *conn.TcpConn:
+			t.TLSConfig = opts.tls
+		case *conn.QuicConn:
+			t.TLSConfig = opts.tls
+		case *conn.WsConn:
+			t.TLSConfig = opts.tls
+		default:
+			return nil, fmt.Errorf("tls is not supported over %s", proto)
+		}
+	}
+	return c, nil
+}
+
+/**
+ * logConfig logs the transport config of proto, so a result can be reproduced
+ */
+func logConfig(tag string, proto string, opts transport) {
+	switch proto {
+	case conn.PROTO_QUIC:
+		ulog.Log().I(tag, "quic config: "+conn.QuicConfigString(opts.quic, opts.zeroRTT, opts.datagram))
+	case conn.PROTO_TCP:
+		o := conn.DefaultTcpOptions()
+		if opts.tcp != nil {
+			o = *opts.tcp
+		}
+		ulog.Log().I(tag, "tcp options: "+o.String())
+	case conn.PROTO_UDP:
+		if opts.multicast != nil {
+			ulog.Log().I(tag, "multicast: "+opts.multicast.String())
+		}
+	}
+}
+
+/**
+ * logSocketInfo logs the socket options in effect on a connected tcp conn
+ */
+func logSocketInfo(tag string, c conn.ConnOp) {
+	if t, ok := c.(*conn.TcpConn); ok {
+		ulog.Log().I(tag, "tcp socket: "+t.SocketInfo())
+	}
+}
@@ -0,0 +1,81 @@
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * Buffer is a message buffer handed over the rx / tx channels.
+ * Sending a Buffer on a channel transfers its ownership: the receiver must call Release once done,
+ * after which the bytes may be reused by another read. The tx tasks release what they write.
+ */
+type Buffer struct {
+	data     []byte
+	pool     *sync.Pool
+	released atomic.Bool
+}
+
+// size classes of the buffer pools, larger buffers are allocated and left to the gc
+var bufferClasses = []int{512, 2 << 10, 16 << 10, 64 << 10, DEFAULT_MAX_FRAME_SIZE}
+var bufferPools = make([]*sync.Pool, len(bufferClasses))
+
+func init() {
+	for i, size := range bufferClasses {
+		size := size
+		bufferPools[i] = &sync.Pool{
+			New: func() any {
+				return make([]byte, size)
+			},
+		}
+	}
+}
+
+/**
+ * AcquireBuffer returns a buffer of length size, taken from a pool when possible
+ */
+func AcquireBuffer(size int) *Buffer {
+	for i, class := range bufferClasses {
+		if size <= class {
+			data := bufferPools[i].Get().([]byte)
+			return &Buffer{data: data[:size], pool: bufferPools[i]}
+		}
+	}
+	return &Buffer{data: make([]byte, size)}
+}
+
+/**
+ * WrapBuffer makes a Buffer of a caller owned slice, Release does not recycle it
+ */
+func WrapBuffer(b []byte) *Buffer {
+	return &Buffer{data: b}
+}
+
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *Buffer) Len() int {
+	return len(b.data)
+}
+
+/**
+ * Truncate shrinks the buffer to n bytes, used after reading less than acquired
+ */
+func (b *Buffer) Truncate(n int) {
+	b.data = b.data[:n]
+}
+
+/**
+ * Release returns the buffer to its pool, the bytes must not be used afterwards.
+ * Releasing twice is a no-op.
+ */
+func (b *Buffer) Release() {
+	if b == nil || !b.released.CompareAndSwap(false, true) {
+		return
+	}
+	if b.pool != nil {
+		b.pool.Put(b.data[:cap(b.data)])
+	}
+	b.data = nil
+}
@@ -0,0 +1,142 @@
+package conn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const CERT_VALIDITY = 365 * 24 * time.Hour
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCA() (*testCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "ucs test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &testCA{cert: cert, key: key, der: der}, nil
+}
+
+/**
+ * issue signs a leaf certificate for the hosts, which are ip addresses or dns names
+ */
+func (ca *testCA) issue(name string, hosts []string, client bool) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func serialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+/**
+ * GenerateTestCerts writes a local test CA and a server and a client certificate signed by it
+ * into dir: ca.pem, server.pem / server.key valid for hosts, client.pem / client.key.
+ * It returns the paths of the written files.
+ */
+func GenerateTestCerts(dir string, hosts []string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ca, err := newCA()
+	if err != nil {
+		return nil, err
+	}
+	server, err := ca.issue("ucs server", hosts, false)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ca.issue("ucs client", nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	write := func(name string, blockType string, bs []byte, perm os.FileMode) error {
+		file := filepath.Join(dir, name)
+		err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bs}), perm)
+		if err == nil {
+			files = append(files, file)
+		}
+		return err
+	}
+	if err = write("ca.pem", "CERTIFICATE", ca.der, 0644); err != nil {
+		return nil, err
+	}
+	for _, leaf := range []struct {
+		name string
+		cert tls.Certificate
+	}{{"server", server}, {"client", client}} {
+		keyDER, err := x509.MarshalECPrivateKey(leaf.cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		if err = write(leaf.name+".pem", "CERTIFICATE", leaf.cert.Certificate[0], 0644); err != nil {
+			return nil, err
+		}
+		if err = write(leaf.name+".key", "EC PRIVATE KEY", keyDER, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
@@ -1,515 +1,239 @@
 package conn
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"math/big"
-	"net"
-	"strconv"
-	"time"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
-	"github.com/quic-go/quic-go"
 	"lingfliu.github.com/ucs_comm_test/ulog"
 	"lingfliu.github.com/ucs_comm_test/utils"
 )
 
+const PROTO_TCP = "tcp"
+const PROTO_UDP = "udp"
+const PROTO_QUIC = "quic"
+const PROTO_WS = "ws"
+const PROTO_UNIX = "unix"
+const PROTO_UNIXGRAM = "unixgram"
+
+/**
+ * ConnOp is the transport interface shared by all conn types.
+ * A listening conn delivers every accepted peer on newC, a dialing conn calls Connect.
+ * After that both sides use the same recv / write tasks, which hand over owned *Buffer messages.
+ *
+ * The tasks stop when their ctx is canceled or the conn is closed, whichever comes first.
+ * Canceling the ctx of a task closes the conn. The recv task closes rx and Accept closes newC on exit,
+ * Done is closed once the conn is finished and Err reports why, as one of the errors in errors.go.
+ */
 type ConnOp interface {
-	Connect() error
+	Connect(ctx context.Context) error
+	Accept(ctx context.Context, newC chan ConnOp) error
 	Close() error
-	StartRecv() error
-	StartWrite() error
+	StartRecv(ctx context.Context, rx chan *Buffer) error
+	StartWrite(ctx context.Context, tx chan *Buffer) error
 	InstantWrite([]byte) error
 	ScheduleWrite([]byte) error
+	RemoteAddr() string
+	LastRecvAt() int64
+	Done() <-chan struct{}
+	Err() error
+}
+
+var errNotConnected = errors.New("conn not connected")
+var errWriteNotStarted = errors.New("write task not started")
+
+/**
+ * NewConn creates a conn of the given protocol, so the transport can be picked at runtime.
+ * The unix protocols take addr as the socket file, or derive it from port if addr is not a path.
+ */
+func NewConn(proto string, addr string, port int) (ConnOp, error) {
+	switch proto {
+	case PROTO_TCP:
+		return NewTcpConn(addr, port), nil
+	case PROTO_UDP:
+		return NewUdpConn(addr, port), nil
+	case PROTO_QUIC:
+		return NewQuicConn(addr, port), nil
+	case PROTO_WS:
+		return NewWsConn(addr, port), nil
+	case PROTO_UNIX:
+		return NewUnixConn(unixPath(addr, port)), nil
+	case PROTO_UNIXGRAM:
+		return NewUnixgramConn(unixPath(addr, port)), nil
+	default:
+		return nil, fmt.Errorf("unknown protocol: %s", proto)
+	}
 }
 
 type BaseConn struct {
 	Addr string
 	Port int
-}
-type QuicConn struct {
-	BaseConn
-	c          quic.Connection
-	listener   *quic.Listener
-	stream     quic.Stream
-	LastRecvAt int64
-	Stat       int
-}
+	// MaxFrameSize bounds a single message on stream transports, DEFAULT_MAX_FRAME_SIZE if 0
+	MaxFrameSize int
+	writeMu      sync.Mutex
 
-func NewQuicConn(addr string, port int) *QuicConn {
-	return &QuicConn{
-		BaseConn: BaseConn{
-			Addr: addr,
-			Port: port,
-		},
-	}
+	mu sync.Mutex
+	// set by StartWrite, possibly on another goroutine than ScheduleWrite
+	txChan     chan *Buffer
+	done       chan struct{}
+	err        error
+	closeOnce  sync.Once
+	lastRecvAt atomic.Int64
 }
 
-// copied from the quic-go example
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
-	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := func() []byte {
-		var buf bytes.Buffer
-		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}); err != nil {
-			return nil
-		}
-		return buf.Bytes()
-	}()
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		panic(err)
-	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"ucs-quic"},
-	}
+func (b *BaseConn) RemoteAddr() string {
+	return utils.UrlCombine(b.Addr, b.Port, "")
 }
 
-func (q *QuicConn) Accept(newC chan *QuicConn) {
-	var addr string
-	if q.Addr == "" {
-		addr = "0.0.0.0:" + strconv.Itoa(q.Port)
-	} else {
-		addr = utils.UrlCombine(q.Addr, q.Port, "")
-	}
-
-	listener, err := quic.ListenAddr(addr, generateTLSConfig(), nil)
-	if err != nil {
-		ulog.Log().I("quic_accept", "listen error: "+err.Error())
-		return
-	}
-	q.listener = listener
-
-	for {
-		c, err := listener.Accept(context.Background())
-		if err != nil {
-			ulog.Log().I("quic_accept", "accept error: "+err.Error())
-			return
-		}
-
-		stream, err := c.AcceptStream(context.Background())
-		if err != nil {
-			ulog.Log().I("quic_accept", "stream error: "+err.Error())
-			c.CloseWithError(2, "open stream failed")
-			continue
-		}
-
-		ulog.Log().I("quic_accept", "new connection from "+c.RemoteAddr().String())
-		qConn := &QuicConn{
-			BaseConn: BaseConn{
-				Addr: c.RemoteAddr().String(),
-				Port: 0, // QUIC doesn't have separate ports for connections
-			},
-			c:      c,
-			stream: stream,
-		}
-		newC <- qConn
-	}
-
+/**
+ * LastRecvAt returns when data was last received in micro seconds, 0 if never
+ */
+func (b *BaseConn) LastRecvAt() int64 {
+	return b.lastRecvAt.Load()
 }
 
-func (q *QuicConn) Listen() int {
-	listener, err := quic.ListenAddr(utils.UrlCombine(q.Addr, q.Port, ""), generateTLSConfig(), nil)
-	if err != nil {
-		return -1
-	}
-
-	for range time.Tick(1 * time.Millisecond) {
-		c, err := listener.Accept(context.Background())
-		if err != nil {
-			return -1
-		}
-
-		stream, err := c.AcceptStream(context.Background())
-		if err != nil {
-			c.CloseWithError(2, "open stream failed")
-			continue
-		}
-		q.stream = stream
-		q.c = c
-
-		break
-	}
-	return 0
+func (b *BaseConn) touch() {
+	b.lastRecvAt.Store(utils.CurrentTimeInMicro())
 }
 
-func (q *QuicConn) Connect() int {
-	tlcConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"ucs-quic"},
+func (b *BaseConn) doneChan() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done == nil {
+		b.done = make(chan struct{})
 	}
-	c, err := quic.DialAddr(context.Background(), utils.UrlCombine(q.Addr, q.Port, ""), tlcConfig, nil)
-	if err != nil {
-		return -1
-	}
-
-	stream, err := c.OpenStreamSync(context.Background())
-	if err != nil {
-		return -1
-	}
-	q.c = c
-	q.stream = stream
-	return 0
+	return b.done
 }
 
-func (q *QuicConn) Close() int {
-	if q.stream != nil {
-		q.stream.Close()
-	}
-	if q.c != nil {
-		err := q.c.CloseWithError(0, "")
-		if err != nil {
-			ulog.Log().I("quic_close", "close error: "+err.Error())
-			return -1
-		}
-	}
-	if q.listener != nil {
-		err := q.listener.Close()
-		if err != nil {
-			ulog.Log().I("quic_close", "listener close error: "+err.Error())
-		}
-	}
-	return 0
+/**
+ * Done is closed when the conn is closed locally, by the peer or by a transport error
+ */
+func (b *BaseConn) Done() <-chan struct{} {
+	return b.doneChan()
 }
 
-func (q *QuicConn) _taskRecv(rx chan []byte) {
-	buff := make([]byte, 1024)
-	for {
-		n, err := q.stream.Read(buff)
-		if err != nil {
-			// Check if it's a connection close error
-			if err.Error() == "Application error 0x0 (remote)" ||
-				err.Error() == "NO_ERROR" ||
-				err.Error() == "stream canceled" {
-				ulog.Log().I("quic_recv", "connection closed gracefully")
-				return
-			}
-			ulog.Log().I("quic_recv", "read error: "+err.Error())
-			time.Sleep(1 * time.Millisecond)
-			continue
-		}
-		if n > 0 {
-			rx <- buff[:n]
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
-	}
-}
-
-func (q *QuicConn) StartRecv(rx chan []byte) {
-	go q._taskRecv(rx)
-}
-
-func (q *QuicConn) StartWrite(tx chan []byte) {
-	go q._task_write(tx)
+/**
+ * Err returns nil while the conn is alive and the terminal error afterwards
+ */
+func (b *BaseConn) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
 }
 
-func (q *QuicConn) _task_write(tx chan []byte) {
-	for {
-		select {
-		case tx_buff := <-tx:
-			_, err := q.stream.Write(tx_buff)
-			if err != nil {
-				if err.Error() == "Application error 0x0 (remote)" ||
-					err.Error() == "NO_ERROR" ||
-					err.Error() == "stream canceled" {
-					ulog.Log().I("quic_write", "connection closed, stopping write task")
-					return
-				}
-				ulog.Log().I("quic_write", "write error: "+err.Error())
-			}
-		}
+/**
+ * terminate records the first terminal error and wakes up every task waiting on Done.
+ * It returns false if the conn was already terminated.
+ */
+func (b *BaseConn) terminate(err error) bool {
+	done := b.doneChan()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return false
 	}
-}
-
-type TcpConn struct {
-	BaseConn
-	c          *net.TCPConn
-	LastRecvAt int64
-	Stat       int
-}
-
-func NewTcpConn(addr string, port int) *TcpConn {
-	return &TcpConn{
-		BaseConn: BaseConn{
-			Addr: addr,
-			Port: port,
-		},
+	if err == nil {
+		err = ErrClosed
 	}
+	b.err = classify(err)
+	close(done)
+	return true
 }
 
-func (t *TcpConn) Accept(newC chan *TcpConn) {
-	addr := net.TCPAddr{
-		IP:   net.ParseIP(t.Addr),
-		Port: t.Port,
-	}
-	l, err := net.ListenTCP("tcp", &addr)
-	if err != nil {
-		ulog.Log().I("accept", "listen error")
-		return
-	}
-	for {
-		c, err := l.AcceptTCP()
-		if err != nil {
-			ulog.Log().I("accept", "accept error")
-			return
-		}
-
-		ulog.Log().I("accept", "new conn from "+c.RemoteAddr().String())
-		t := &TcpConn{
-			BaseConn: BaseConn{
-				Addr: c.RemoteAddr().(*net.TCPAddr).IP.String(),
-				Port: c.RemoteAddr().(*net.TCPAddr).Port,
-			},
-			c: c,
-		}
-		newC <- t
-	}
+/**
+ * release runs the socket teardown of Close exactly once, later calls return nil
+ */
+func (b *BaseConn) release(teardown func() error) error {
+	var err error
+	b.closeOnce.Do(func() {
+		err = teardown()
+	})
+	return err
 }
 
-func (t *TcpConn) Connect() int {
-	addr := net.TCPAddr{
-		IP:   net.ParseIP(t.Addr),
-		Port: t.Port,
-	}
-	c, err := net.DialTCP("tcp", nil, &addr)
-	if err != nil {
-		return -1
-	}
-	t.c = c
-	return 0
-}
-
-func (t *TcpConn) Close() int {
-	t.c.Close()
-	return 0
-}
-
-func (t *TcpConn) _taskRecv(rx chan []byte) {
-	buff := make([]byte, 1024)
-	for {
-		n, err := t.c.Read(buff)
-		if err != nil {
-			// ulog.Log().Tag("conn").I("read error: ", err)
-			time.Sleep(1 * time.Millisecond)
-		} else {
-			if n > 0 {
-				// do something
-				rx <- buff[:n]
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
-	}
-}
-
-func (t *TcpConn) StartRecv(rx chan []byte) {
-	go t._taskRecv(rx)
-}
-
-func (t *TcpConn) _task_write(tx chan []byte) {
-	for {
+/**
+ * closeOnCancel closes the conn once ctx is done, unless the conn finishes first
+ */
+func (b *BaseConn) closeOnCancel(ctx context.Context, closer func() error) {
+	done := b.doneChan()
+	go func() {
 		select {
-		case tx_buff := <-tx:
-			t.c.Write(tx_buff)
-		}
-	}
-}
-
-func (t *TcpConn) StartWrite(tx chan []byte) {
-	go t._task_write(tx)
-}
-
-type UdpConn struct {
-	BaseConn
-	c          *net.UDPConn
-	remoteAddr *net.UDPAddr
-	LastRecvAt int64
-	Stat       int
-	rxChan     chan []byte
-}
-
-func NewUdpConn(addr string, port int) *UdpConn {
-	return &UdpConn{
-		BaseConn: BaseConn{
-			Addr: addr,
-			Port: port,
-		},
-	}
-}
-
-func (u *UdpConn) Accept(newC chan *UdpConn) {
-	var addr net.UDPAddr
-	if u.Addr == "" {
-		addr = net.UDPAddr{
-			IP:   nil, // Listen on all interfaces
-			Port: u.Port,
-		}
-	} else {
-		addr = net.UDPAddr{
-			IP:   net.ParseIP(u.Addr),
-			Port: u.Port,
-		}
-	}
-
-	l, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		ulog.Log().I("udp_accept", "listen error: "+err.Error())
-		return
-	}
-	u.c = l
-
-	// For UDP server, we don't have traditional "connections", but we track clients
-	clients := make(map[string]*UdpConn)
-	buff := make([]byte, 1024)
-
-	for {
-		n, clientAddr, err := l.ReadFromUDP(buff)
-		if err != nil {
-			// Check if it's a connection close error
-			if err.Error() == "use of closed network connection" ||
-				err.Error() == "connection closed" {
-				ulog.Log().I("udp_accept", "listener closed, stopping accept")
-				return
-			}
-			ulog.Log().I("udp_accept", "read error: "+err.Error())
-			continue
+		case <-ctx.Done():
+			closer()
+		case <-done:
 		}
-
-		clientKey := clientAddr.String()
-		client, exists := clients[clientKey]
-
-		if !exists {
-			ulog.Log().I("udp_accept", "new client from "+clientAddr.String())
-			client = &UdpConn{
-				BaseConn: BaseConn{
-					Addr: clientAddr.IP.String(),
-					Port: clientAddr.Port,
-				},
-				c:          l,
-				remoteAddr: clientAddr,
-			}
-			clients[clientKey] = client
-			newC <- client
-		}
-
-		// Forward the received data to the client's receiver if it has one
-		if client.rxChan != nil {
-			client.rxChan <- buff[:n]
-		}
-	}
+	}()
 }
 
-func (u *UdpConn) Connect() int {
-	addr := net.UDPAddr{
-		IP:   net.ParseIP(u.Addr),
-		Port: u.Port,
-	}
-	c, err := net.DialUDP("udp", nil, &addr)
-	if err != nil {
-		return -1
-	}
-	u.c = c
-	// Don't set remoteAddr for client - this is only for server-side client tracking
-	return 0
+func (b *BaseConn) setTxChan(tx chan *Buffer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.txChan = tx
 }
 
-func (u *UdpConn) Close() int {
-	if u.c != nil {
-		err := u.c.Close()
-		if err != nil {
-			ulog.Log().I("udp_close", "close error: "+err.Error())
-			return -1
-		}
+/**
+ * ScheduleWrite queues data on the channel given to StartWrite, data must not be modified afterwards
+ */
+func (b *BaseConn) ScheduleWrite(data []byte) error {
+	b.mu.Lock()
+	tx := b.txChan
+	b.mu.Unlock()
+	if tx == nil {
+		return errWriteNotStarted
 	}
-	return 0
-}
-
-func (u *UdpConn) _taskRecv(rx chan []byte) {
-	u.rxChan = rx
-	buff := make([]byte, 1024)
-	for {
-		var n int
-		var err error
-
-		if u.remoteAddr != nil {
-			// Server mode - this is handled in Accept(), just wait for data
-			time.Sleep(1 * time.Millisecond)
-			continue
-		}
-
-		// Client mode - read directly from connection
-		n, err = u.c.Read(buff)
-
-		if err != nil {
-			// Check if it's a connection close error
-			if err.Error() == "use of closed network connection" ||
-				err.Error() == "connection closed" {
-				ulog.Log().I("udp_recv", "connection closed, stopping receive")
-				return
-			}
-			ulog.Log().I("udp_recv", "read error: "+err.Error())
-			time.Sleep(1 * time.Millisecond)
-			return
-		} else {
-			if n > 0 {
-				rx <- buff[:n]
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
+	select {
+	case tx <- WrapBuffer(data):
+		return nil
+	case <-b.doneChan():
+		return b.Err()
 	}
 }
 
-func (u *UdpConn) StartRecv(rx chan []byte) {
-	go u._taskRecv(rx)
-}
-
-func (u *UdpConn) _task_write(tx chan []byte) {
+/**
+ * _task_write drains tx into write until ctx is done or the conn finishes.
+ * A write error is terminal: the conn is closed with it.
+ */
+func (b *BaseConn) _task_write(ctx context.Context, tag string, tx chan *Buffer, write func([]byte) error, closer func() error) {
+	done := b.doneChan()
 	for {
 		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
 		case tx_buff := <-tx:
-			if u.remoteAddr != nil {
-				// Server mode - responding to specific client, or client mode
-				_, err := u.c.WriteToUDP(tx_buff, u.remoteAddr)
-				if err != nil {
-					if err.Error() == "use of closed network connection" ||
-						err.Error() == "connection closed" {
-						ulog.Log().I("udp_write", "connection closed, stopping write task")
-						return
-					}
-					ulog.Log().I("udp_write", "write error: "+err.Error())
-				}
-			} else {
-				// Client mode with DialUDP connection
-				_, err := u.c.Write(tx_buff)
-				if err != nil {
-					if err.Error() == "use of closed network connection" ||
-						err.Error() == "connection closed" {
-						ulog.Log().I("udp_write", "connection closed, stopping write task")
-						return
-					}
-					ulog.Log().I("udp_write", "write error: "+err.Error())
+			err := write(tx_buff.Bytes())
+			tx_buff.Release()
+			if err != nil {
+				if b.terminate(err) && !isClosed(b.Err()) {
+					ulog.Log().I(tag, "write error: "+err.Error())
 				}
+				closer()
+				return
 			}
 		}
 	}
 }
 
-func (u *UdpConn) StartWrite(tx chan []byte) {
-	go u._task_write(tx)
+/**
+ * deliver hands a received buffer to rx, or releases it if the conn finishes first
+ */
+func (b *BaseConn) deliver(ctx context.Context, rx chan *Buffer, buff *Buffer) bool {
+	b.touch()
+	select {
+	case rx <- buff:
+		return true
+	case <-ctx.Done():
+	case <-b.doneChan():
+	}
+	buff.Release()
+	return false
 }
+
+var _ ConnOp = (*TcpConn)(nil)
+var _ ConnOp = (*UdpConn)(nil)
+var _ ConnOp = (*QuicConn)(nil)
+var _ ConnOp = (*WsConn)(nil)
+var _ ConnOp = (*UnixConn)(nil)
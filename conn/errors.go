@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/websocket"
+)
+
+/**
+ * Terminal errors of a conn, reported by Err and by the failing calls.
+ * Match them with errors.Is, the transport error stays reachable with errors.As / errors.Unwrap.
+ */
+var ErrClosed = errors.New("conn closed")
+var ErrRemoteClosed = errors.New("conn closed by remote")
+var ErrTimeout = errors.New("conn timeout")
+var ErrFrameTooLarge = errors.New("frame too large")
+
+/**
+ * ConnError pairs one of the sentinel errors above with the transport error behind it
+ */
+type ConnError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ConnError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+/**
+ * classify maps a transport error of net, os or quic-go onto the sentinel errors
+ */
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrClosed) || errors.Is(err, ErrRemoteClosed) ||
+		errors.Is(err, ErrTimeout) || errors.Is(err, ErrFrameTooLarge) {
+		return err
+	}
+
+	// quic-go errors all match net.ErrClosed, so they are told apart first
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		if appErr.Remote {
+			return &ConnError{Kind: ErrRemoteClosed, Err: err}
+		}
+		return &ConnError{Kind: ErrClosed, Err: err}
+	}
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) && transportErr.Remote {
+		return &ConnError{Kind: ErrRemoteClosed, Err: err}
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		if streamErr.Remote {
+			return &ConnError{Kind: ErrRemoteClosed, Err: err}
+		}
+		return &ConnError{Kind: ErrClosed, Err: err}
+	}
+	var datagramErr *quic.DatagramTooLargeError
+	if errors.As(err, &datagramErr) {
+		return &ConnError{Kind: ErrFrameTooLarge, Err: err}
+	}
+	if errors.Is(err, websocket.ErrFrameTooLarge) {
+		return &ConnError{Kind: ErrFrameTooLarge, Err: err}
+	}
+	var idleErr *quic.IdleTimeoutError
+	var handshakeErr *quic.HandshakeTimeoutError
+	if errors.As(err, &idleErr) || errors.As(err, &handshakeErr) {
+		return &ConnError{Kind: ErrTimeout, Err: err}
+	}
+
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ECONNREFUSED):
+		return &ConnError{Kind: ErrRemoteClosed, Err: err}
+	case errors.Is(err, net.ErrClosed):
+		return &ConnError{Kind: ErrClosed, Err: err}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return &ConnError{Kind: ErrTimeout, Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &ConnError{Kind: ErrTimeout, Err: err}
+	}
+	return err
+}
+
+/**
+ * isClosed tells a normal shutdown from a transport failure, for logging
+ */
+func isClosed(err error) bool {
+	return errors.Is(err, ErrClosed) || errors.Is(err, ErrRemoteClosed)
+}
@@ -0,0 +1,72 @@
+package conn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+/**
+ * Stream transports (tcp, quic stream) carry length prefixed frames:
+ * bytes 0-3: payload length (uint32, little-endian)
+ * bytes 4- : payload
+ * so one frame on the wire is delivered as one message on the rx channel.
+ */
+const FRAME_HEADER_LEN = 4
+const DEFAULT_MAX_FRAME_SIZE = 1 << 20
+
+type FrameReader struct {
+	r       *bufio.Reader
+	maxSize int
+	hdr     [FRAME_HEADER_LEN]byte
+}
+
+func NewFrameReader(r io.Reader, maxSize int) *FrameReader {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_FRAME_SIZE
+	}
+	return &FrameReader{
+		r:       bufio.NewReader(r),
+		maxSize: maxSize,
+	}
+}
+
+/**
+ * ReadFrame blocks until a whole frame is read and returns its payload, owned by the caller
+ */
+func (f *FrameReader) ReadFrame() (*Buffer, error) {
+	if _, err := io.ReadFull(f.r, f.hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(f.hdr[:])
+	if uint64(n) > uint64(f.maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+	payload := AcquireBuffer(int(n))
+	if _, err := io.ReadFull(f.r, payload.Bytes()); err != nil {
+		payload.Release()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+/**
+ * WriteFrame writes header and payload in a single Write so a frame is never split by a concurrent writer
+ */
+func WriteFrame(w io.Writer, data []byte, maxSize int) error {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_FRAME_SIZE
+	}
+	if len(data) > maxSize {
+		return ErrFrameTooLarge
+	}
+	frame := AcquireBuffer(FRAME_HEADER_LEN + len(data))
+	defer frame.Release()
+	binary.LittleEndian.PutUint32(frame.Bytes(), uint32(len(data)))
+	copy(frame.Bytes()[FRAME_HEADER_LEN:], data)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
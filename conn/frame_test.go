@@ -0,0 +1,120 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		size    int
+		maxSize int
+	}{
+		{"empty", 0, 0},
+		{"small", 44, 0},
+		{"at the default limit", DEFAULT_MAX_FRAME_SIZE, 0},
+		{"at a custom limit", 4096, 4096},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data := make([]byte, c.size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			var wire bytes.Buffer
+			if err := WriteFrame(&wire, data, c.maxSize); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if wire.Len() != FRAME_HEADER_LEN+c.size {
+				t.Fatalf("frame of %d bytes, want %d", wire.Len(), FRAME_HEADER_LEN+c.size)
+			}
+			b, err := NewFrameReader(&wire, c.maxSize).ReadFrame()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			defer b.Release()
+			if !bytes.Equal(b.Bytes(), data) {
+				t.Fatalf("read %d bytes back, want %d", b.Len(), c.size)
+			}
+		})
+	}
+}
+
+func TestFrameSequence(t *testing.T) {
+	var wire bytes.Buffer
+	msgs := []string{"ping", "", "pong"}
+	for _, m := range msgs {
+		if err := WriteFrame(&wire, []byte(m), 0); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	r := NewFrameReader(&wire, 0)
+	for _, m := range msgs {
+		b, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(b.Bytes()) != m {
+			t.Fatalf("read %q, want %q", b.Bytes(), m)
+		}
+		b.Release()
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Fatalf("read past the last frame: %v, want EOF", err)
+	}
+}
+
+func TestFrameRejected(t *testing.T) {
+	header := func(n uint32) []byte {
+		hdr := make([]byte, FRAME_HEADER_LEN)
+		binary.LittleEndian.PutUint32(hdr, n)
+		return hdr
+	}
+	cases := []struct {
+		name    string
+		wire    []byte
+		maxSize int
+		want    error
+	}{
+		{"past the default limit", header(DEFAULT_MAX_FRAME_SIZE + 1), 0, ErrFrameTooLarge},
+		{"past a custom limit", header(4097), 4096, ErrFrameTooLarge},
+		{"max uint32", header(^uint32(0)), 0, ErrFrameTooLarge},
+		{"truncated header", header(4)[:2], 0, io.ErrUnexpectedEOF},
+		{"truncated payload", append(header(4), 1, 2), 0, io.ErrUnexpectedEOF},
+		{"missing payload", header(4), 0, io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewFrameReader(bytes.NewReader(c.wire), c.maxSize).ReadFrame()
+			if !errors.Is(err, c.want) {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	cases := []struct {
+		name    string
+		size    int
+		maxSize int
+	}{
+		{"past the default limit", DEFAULT_MAX_FRAME_SIZE + 1, 0},
+		{"past a custom limit", 4097, 4096},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var wire bytes.Buffer
+			if err := WriteFrame(&wire, make([]byte, c.size), c.maxSize); !errors.Is(err, ErrFrameTooLarge) {
+				t.Fatalf("got %v, want %v", err, ErrFrameTooLarge)
+			}
+			if wire.Len() != 0 {
+				t.Fatalf("wrote %d bytes of a rejected frame", wire.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/ipv4"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+const DEFAULT_MULTICAST_TTL = 1
+
+var errNotMulticast = errors.New("not a connected multicast conn")
+
+/**
+ * MulticastOptions makes a UdpConn one-to-many. A listening conn binds the port of the conn with
+ * address reuse, so several responders can run on one host, joins Group and replies from a socket
+ * of its own. A dialing conn sends every message to Group and takes the replies of all responders
+ * through Responders. A broadcast Group joins nothing, go enables SO_BROADCAST on every udp socket.
+ */
+type MulticastOptions struct {
+	// Group is an ipv4 multicast or broadcast address
+	Group string
+	// Interface names the interface to join and send on, picked by the routing table if empty
+	Interface string
+	// TTL of the sent datagrams, DEFAULT_MULTICAST_TTL keeps them on the local network
+	TTL int
+	// Loopback delivers the sent datagrams to the responders of the sending host too
+	Loopback bool
+}
+
+func DefaultMulticastOptions(group string) MulticastOptions {
+	return MulticastOptions{
+		Group:    group,
+		TTL:      DEFAULT_MULTICAST_TTL,
+		Loopback: true,
+	}
+}
+
+func (o MulticastOptions) String() string {
+	ifname := o.Interface
+	if ifname == "" {
+		ifname = "default"
+	}
+	return fmt.Sprintf("group = %s, interface = %s, ttl = %d, loopback = %v", o.Group, ifname, o.TTL, o.Loopback)
+}
+
+func (o MulticastOptions) resolve(port int) (*net.UDPAddr, *net.Interface, error) {
+	ip := net.ParseIP(o.Group).To4()
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid ipv4 group: %s", o.Group)
+	}
+	var ifi *net.Interface
+	if o.Interface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(o.Interface); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, ifi, nil
+}
+
+/**
+ * listenGroup binds the responder side of a multicast conn and joins its group
+ */
+func (u *UdpConn) listenGroup() (packetConn, error) {
+	group, ifi, err := u.Multicast.resolve(u.Port)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: reuseControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort("", strconv.Itoa(u.Port)))
+	if err != nil {
+		return nil, err
+	}
+	c := pc.(*net.UDPConn)
+	reply, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if group.IP.IsMulticast() {
+		if err = ipv4.NewPacketConn(c).JoinGroup(ifi, group); err != nil {
+			c.Close()
+			reply.Close()
+			return nil, err
+		}
+		ulog.Log().I("udp_accept", "joined group "+group.IP.String())
+	}
+	u.replyC = reply
+	return c, nil
+}
+
+/**
+ * JoinGroup adds a multicast group to a listening multicast conn, on the interface of its options
+ */
+func (u *UdpConn) JoinGroup(group string) error {
+	return u.groupMembership(group, true)
+}
+
+/**
+ * LeaveGroup drops a multicast group of a listening conn, closing the conn leaves all of them
+ */
+func (u *UdpConn) LeaveGroup(group string) error {
+	return u.groupMembership(group, false)
+}
+
+func (u *UdpConn) groupMembership(group string, join bool) error {
+	c, ok := u.c.(*net.UDPConn)
+	if !ok || u.Multicast == nil || u.srv != nil {
+		return errNotMulticast
+	}
+	o := *u.Multicast
+	o.Group = group
+	addr, ifi, err := o.resolve(u.Port)
+	if err != nil {
+		return err
+	}
+	if join {
+		return ipv4.NewPacketConn(c).JoinGroup(ifi, addr)
+	}
+	return ipv4.NewPacketConn(c).LeaveGroup(ifi, addr)
+}
+
+/**
+ * connectGroup binds the sending side of a multicast conn, which writes to the group
+ */
+func (u *UdpConn) connectGroup() error {
+	group, ifi, err := u.Multicast.resolve(u.Port)
+	if err != nil {
+		return err
+	}
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	if group.IP.IsMulticast() {
+		p := ipv4.NewPacketConn(c)
+		ttl := u.Multicast.TTL
+		if ttl <= 0 {
+			ttl = DEFAULT_MULTICAST_TTL
+		}
+		err = p.SetMulticastTTL(ttl)
+		if err == nil {
+			err = p.SetMulticastLoopback(u.Multicast.Loopback)
+		}
+		if err == nil && ifi != nil {
+			err = p.SetMulticastInterface(ifi)
+		}
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	u.Addr = group.IP.String()
+	u.c = c
+	u.remoteAddr = group
+	return nil
+}
+
+/**
+ * Responders demultiplexes the replies to a connected multicast conn onto one conn per responder,
+ * delivered on newC like the peers of Accept. It takes the place of StartRecv and returns once the conn is closed.
+ */
+func (u *UdpConn) Responders(ctx context.Context, newC chan ConnOp) error {
+	defer close(newC)
+	if u.c == nil || u.Multicast == nil || u.srv != nil {
+		return errNotMulticast
+	}
+	u.peersMu.Lock()
+	u.peers = make(map[string]*UdpConn)
+	u.peersMu.Unlock()
+	u.closeOnCancel(ctx, u.Close)
+	return u.serve(ctx, "udp_group", newC)
+}
@@ -0,0 +1,449 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+var errNoDatagrams = errors.New("peer does not support quic datagrams")
+
+// quic-go defaults of the quic.Config fields left 0, for logging the effective config
+const DEFAULT_QUIC_HANDSHAKE_TIMEOUT = 5 * time.Second
+const DEFAULT_QUIC_IDLE_TIMEOUT = 30 * time.Second
+const DEFAULT_QUIC_STREAM_WINDOW = 512 << 10
+const DEFAULT_QUIC_MAX_STREAM_WINDOW = 6 << 20
+const DEFAULT_QUIC_CONN_WINDOW = 768 << 10
+const DEFAULT_QUIC_MAX_CONN_WINDOW = 15 << 20
+const DEFAULT_QUIC_MAX_STREAMS = 100
+
+type QuicConn struct {
+	BaseConn
+	// TLSConfig of the quic handshake, a self-signed server and a client verifying against the system roots if nil
+	TLSConfig *tls.Config
+	// Config tunes the quic transport, quic-go defaults if nil. ZeroRTT and Datagram override its
+	// Allow0RTT and EnableDatagrams. A listener hands the config on to every accepted connection.
+	Config *quic.Config
+	// ZeroRTT dials and listens in early mode: holding a session ticket of an earlier conn in
+	// TLSConfig.ClientSessionCache, Connect returns before the handshake and the first writes go out as 0-RTT data
+	ZeroRTT bool
+	// Datagram carries the messages in unreliable DATAGRAM frames (RFC 9221) instead of a stream,
+	// a message must then fit into a single quic packet
+	Datagram bool
+	c        quic.Connection
+	// refs counts the stream conns sharing c, the last one to close closes c
+	refs          *atomic.Int32
+	listener      *quic.Listener
+	earlyListener *quic.EarlyListener
+	stream        quic.Stream
+}
+
+func NewQuicConn(addr string, port int) *QuicConn {
+	return &QuicConn{
+		BaseConn: BaseConn{
+			Addr: addr,
+			Port: port,
+		},
+	}
+}
+
+func (q *QuicConn) Accept(ctx context.Context, newC chan ConnOp) error {
+	defer close(newC)
+	var addr string
+	if q.Addr == "" {
+		addr = "0.0.0.0:" + strconv.Itoa(q.Port)
+	} else {
+		addr = utils.UrlCombine(q.Addr, q.Port, "")
+	}
+
+	tlsConfig := q.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCert()}}
+	}
+	tlsConfig = withALPN(tlsConfig, ALPN_QUIC, "")
+
+	var accept func(ctx context.Context) (quic.Connection, error)
+	var closeListener func() error
+	if q.ZeroRTT {
+		listener, err := quic.ListenAddrEarly(addr, tlsConfig, q.quicConfig())
+		if err != nil {
+			ulog.Log().I("quic_accept", "listen error: "+err.Error())
+			return err
+		}
+		q.earlyListener = listener
+		accept = func(ctx context.Context) (quic.Connection, error) {
+			return listener.Accept(ctx)
+		}
+		closeListener = listener.Close
+	} else {
+		listener, err := quic.ListenAddr(addr, tlsConfig, q.quicConfig())
+		if err != nil {
+			ulog.Log().I("quic_accept", "listen error: "+err.Error())
+			return err
+		}
+		q.listener = listener
+		accept = listener.Accept
+		closeListener = listener.Close
+	}
+	q.closeOnCancel(ctx, q.Close)
+
+	// stream handshakes run per connection, newC is closed only after all of them returned
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	actx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for {
+		c, err := accept(actx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if q.terminate(err) {
+				ulog.Log().I("quic_accept", "accept error: "+err.Error())
+				closeListener()
+			}
+			return q.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q._taskAcceptStreams(actx, c, newC)
+		}()
+	}
+}
+
+func (q *QuicConn) quicConfig() *quic.Config {
+	return effectiveQuicConfig(q.Config, q.ZeroRTT, q.Datagram)
+}
+
+func effectiveQuicConfig(config *quic.Config, zeroRTT bool, datagram bool) *quic.Config {
+	cfg := &quic.Config{}
+	if config != nil {
+		cfg = config.Clone()
+	}
+	cfg.Allow0RTT = zeroRTT
+	cfg.EnableDatagrams = datagram
+	return cfg
+}
+
+/**
+ * ConfigString describes the effective quic config of the conn, with the defaults filled in
+ */
+func (q *QuicConn) ConfigString() string {
+	return QuicConfigString(q.Config, q.ZeroRTT, q.Datagram)
+}
+
+/**
+ * QuicConfigString describes the quic config a conn with these settings runs with, before creating one
+ */
+func QuicConfigString(config *quic.Config, zeroRTT bool, datagram bool) string {
+	cfg := effectiveQuicConfig(config, zeroRTT, datagram)
+	or := func(v, def int64) int64 {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	keepAlive := "off"
+	if cfg.KeepAlivePeriod > 0 {
+		keepAlive = cfg.KeepAlivePeriod.String()
+	}
+	return fmt.Sprintf("handshake_timeout = %s, idle_timeout = %s, keepalive = %s, "+
+		"stream_window = %d / %d, conn_window = %d / %d, max_streams = %d, 0rtt = %t, datagrams = %t",
+		time.Duration(or(int64(cfg.HandshakeIdleTimeout), int64(DEFAULT_QUIC_HANDSHAKE_TIMEOUT))),
+		time.Duration(or(int64(cfg.MaxIdleTimeout), int64(DEFAULT_QUIC_IDLE_TIMEOUT))),
+		keepAlive,
+		or(int64(cfg.InitialStreamReceiveWindow), DEFAULT_QUIC_STREAM_WINDOW),
+		or(int64(cfg.MaxStreamReceiveWindow), DEFAULT_QUIC_MAX_STREAM_WINDOW),
+		or(int64(cfg.InitialConnectionReceiveWindow), DEFAULT_QUIC_CONN_WINDOW),
+		or(int64(cfg.MaxConnectionReceiveWindow), DEFAULT_QUIC_MAX_CONN_WINDOW),
+		or(cfg.MaxIncomingStreams, DEFAULT_QUIC_MAX_STREAMS),
+		cfg.Allow0RTT, cfg.EnableDatagrams)
+}
+
+/**
+ * _taskAcceptStreams delivers every stream the client opens as a conn of its own,
+ * or the connection itself in Datagram mode
+ */
+func (q *QuicConn) _taskAcceptStreams(ctx context.Context, c quic.Connection, newC chan ConnOp) {
+	refs := new(atomic.Int32)
+	if q.Datagram {
+		if !c.ConnectionState().SupportsDatagrams {
+			ulog.Log().I("quic_accept", "client without datagram support from "+c.RemoteAddr().String())
+			c.CloseWithError(4, errNoDatagrams.Error())
+			return
+		}
+		ulog.Log().I("quic_accept", "new connection from "+c.RemoteAddr().String())
+		q.emit(ctx, newC, q.newStreamConn(c, nil, refs, true))
+		return
+	}
+
+	for n := 0; ; n++ {
+		stream, err := c.AcceptStream(ctx)
+		if err != nil {
+			if n == 0 {
+				ulog.Log().I("quic_accept", "stream error: "+err.Error())
+				c.CloseWithError(2, "open stream failed")
+			}
+			return
+		}
+		if n == 0 {
+			ulog.Log().I("quic_accept", "new connection from "+c.RemoteAddr().String())
+		} else {
+			ulog.Log().I("quic_accept", fmt.Sprintf("new stream %d from %s", stream.StreamID(), c.RemoteAddr()))
+		}
+		if !q.emit(ctx, newC, q.newStreamConn(c, stream, refs, false)) {
+			return
+		}
+	}
+}
+
+func (q *QuicConn) emit(ctx context.Context, newC chan ConnOp, qConn *QuicConn) bool {
+	select {
+	case newC <- qConn:
+		return true
+	case <-ctx.Done():
+		qConn.Close()
+		return false
+	}
+}
+
+/**
+ * newStreamConn wraps one stream of c, taking a reference on c and the frame size limit of q
+ */
+func (q *QuicConn) newStreamConn(c quic.Connection, stream quic.Stream, refs *atomic.Int32, datagram bool) *QuicConn {
+	refs.Add(1)
+	remote := c.RemoteAddr().(*net.UDPAddr)
+	return &QuicConn{
+		BaseConn: BaseConn{
+			Addr:         remote.IP.String(),
+			Port:         remote.Port,
+			MaxFrameSize: q.MaxFrameSize,
+		},
+		Datagram: datagram,
+		c:        c,
+		refs:     refs,
+		stream:   stream,
+	}
+}
+
+/**
+ * OpenStream opens another stream on the connection of a connected conn. The new conn has its own
+ * recv / write tasks, closing it only closes its stream, the connection is closed with the last stream.
+ */
+func (q *QuicConn) OpenStream(ctx context.Context) (*QuicConn, error) {
+	if q.c == nil || q.stream == nil {
+		return nil, errNotConnected
+	}
+	stream, err := q.c.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, classify(err)
+	}
+	s := q.newStreamConn(q.c, stream, q.refs, false)
+	s.Addr = q.Addr
+	s.Port = q.Port
+	return s, nil
+}
+
+/**
+ * Connect dials the server and opens the stream unless in Datagram mode, ctx only bounds the handshake.
+ * In ZeroRTT mode a rejected 0-RTT attempt fails the conn with quic.Err0RTTRejected.
+ * Without TLSConfig the server is verified against the system roots.
+ */
+func (q *QuicConn) Connect(ctx context.Context) error {
+	tlsConfig := q.TLSConfig
+	if tlsConfig == nil {
+		// verified against the system roots
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = withALPN(tlsConfig, ALPN_QUIC, q.Addr)
+	addr := utils.UrlCombine(q.Addr, q.Port, "")
+
+	var c quic.Connection
+	var err error
+	if q.ZeroRTT {
+		c, err = quic.DialAddrEarly(ctx, addr, tlsConfig, q.quicConfig())
+	} else {
+		c, err = quic.DialAddr(ctx, addr, tlsConfig, q.quicConfig())
+	}
+	if err != nil {
+		return err
+	}
+	if q.Datagram {
+		if !c.ConnectionState().SupportsDatagrams {
+			c.CloseWithError(4, errNoDatagrams.Error())
+			return errNoDatagrams
+		}
+	} else {
+		stream, err := c.OpenStreamSync(ctx)
+		if err != nil {
+			c.CloseWithError(2, "open stream failed")
+			return err
+		}
+		q.stream = stream
+	}
+	q.c = c
+	q.refs = new(atomic.Int32)
+	q.refs.Add(1)
+	return nil
+}
+
+/**
+ * WaitHandshake blocks until the handshake of a ZeroRTT conn is complete and reports whether it used 0-RTT,
+ * other conns are complete once connected
+ */
+func (q *QuicConn) WaitHandshake(ctx context.Context) (bool, error) {
+	if q.c == nil {
+		return false, errNotConnected
+	}
+	if early, ok := q.c.(quic.EarlyConnection); ok {
+		select {
+		case <-early.HandshakeComplete():
+		case <-q.c.Context().Done():
+			return false, classify(context.Cause(q.c.Context()))
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	return q.c.ConnectionState().Used0RTT, nil
+}
+
+func (q *QuicConn) Close() error {
+	q.terminate(ErrClosed)
+	return q.release(func() error {
+		if q.stream != nil {
+			q.stream.Close()
+			q.stream.CancelRead(0)
+		}
+		if q.c != nil && q.refs.Add(-1) == 0 {
+			err := q.c.CloseWithError(0, "")
+			if err != nil {
+				ulog.Log().I("quic_close", "close error: "+err.Error())
+				return err
+			}
+		}
+		if q.listener != nil {
+			err := q.listener.Close()
+			if err != nil {
+				ulog.Log().I("quic_close", "listener close error: "+err.Error())
+				return err
+			}
+		}
+		if q.earlyListener != nil {
+			err := q.earlyListener.Close()
+			if err != nil {
+				ulog.Log().I("quic_close", "listener close error: "+err.Error())
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (q *QuicConn) _taskRecv(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	fr := NewFrameReader(q.stream, q.MaxFrameSize)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			if q.terminate(err) {
+				if isClosed(q.Err()) {
+					ulog.Log().I("quic_recv", "connection closed gracefully")
+				} else {
+					// the stream cannot be resynchronized after a broken frame
+					ulog.Log().I("quic_recv", "read error: "+err.Error())
+					q.stream.CancelRead(3)
+				}
+			}
+			q.Close()
+			return
+		}
+		if !q.deliver(ctx, rx, frame) {
+			return
+		}
+	}
+}
+
+/**
+ * _taskRecvDatagram delivers every received DATAGRAM frame as one message
+ */
+func (q *QuicConn) _taskRecvDatagram(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	for {
+		bs, err := q.c.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() == nil && q.terminate(err) {
+				if isClosed(q.Err()) {
+					ulog.Log().I("quic_recv", "connection closed gracefully")
+				} else {
+					ulog.Log().I("quic_recv", "read error: "+err.Error())
+				}
+			}
+			q.Close()
+			return
+		}
+		if !q.deliver(ctx, rx, WrapBuffer(bs)) {
+			return
+		}
+	}
+}
+
+/**
+ * connected tells whether the conn can carry messages: it needs the stream, or only the connection in Datagram mode
+ */
+func (q *QuicConn) connected() bool {
+	if q.Datagram {
+		return q.c != nil
+	}
+	return q.stream != nil
+}
+
+func (q *QuicConn) StartRecv(ctx context.Context, rx chan *Buffer) error {
+	if !q.connected() {
+		return errNotConnected
+	}
+	q.closeOnCancel(ctx, q.Close)
+	if q.Datagram {
+		go q._taskRecvDatagram(ctx, rx)
+		return nil
+	}
+	go q._taskRecv(ctx, rx)
+	return nil
+}
+
+func (q *QuicConn) StartWrite(ctx context.Context, tx chan *Buffer) error {
+	if !q.connected() {
+		return errNotConnected
+	}
+	q.setTxChan(tx)
+	q.closeOnCancel(ctx, q.Close)
+	go q._task_write(ctx, "quic_write", tx, q.InstantWrite, q.Close)
+	return nil
+}
+
+/**
+ * InstantWrite sends data as one frame on the stream, or as one DATAGRAM frame in Datagram mode
+ */
+func (q *QuicConn) InstantWrite(data []byte) error {
+	if !q.connected() {
+		return errNotConnected
+	}
+	if q.Datagram {
+		return classify(q.c.SendDatagram(data))
+	}
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	return classify(WriteFrame(q.stream, data, q.MaxFrameSize))
+}
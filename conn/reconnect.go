@@ -0,0 +1,195 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+const STATE_CONNECTING = 0
+const STATE_CONNECTED = 1
+const STATE_DISCONNECTED = 2
+const STATE_CLOSED = 3
+
+var ErrGiveUp = errors.New("reconnect attempts exhausted")
+
+/**
+ * Backoff is an exponential backoff with jitter between connect attempts
+ */
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter randomizes each delay by +-Jitter (0..1) of its value
+	Jitter float64
+	// MaxAttempts bounds the consecutive failed attempts, 0 for no limit
+	MaxAttempts int
+}
+
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial:    100 * time.Millisecond,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+}
+
+/**
+ * Delay returns the wait before the given attempt, counted from 0
+ */
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+/**
+ * ReconnConn keeps a client conn up: it dials with backoff and dials again whenever the conn is lost.
+ * Dial must return a fresh, unconnected conn for every attempt.
+ */
+type ReconnConn struct {
+	Dial    func() ConnOp
+	Backoff Backoff
+	// ConnectTimeout bounds a single connect attempt
+	ConnectTimeout time.Duration
+	// OnStateChange is called from the Run goroutine on every state change, err tells why a conn was lost
+	OnStateChange func(state int, err error)
+
+	mu    sync.Mutex
+	state int
+	c     ConnOp
+}
+
+func NewReconnConn(dial func() ConnOp, backoff Backoff) *ReconnConn {
+	return &ReconnConn{
+		Dial:           dial,
+		Backoff:        backoff,
+		ConnectTimeout: 5 * time.Second,
+		state:          STATE_CLOSED,
+	}
+}
+
+func (r *ReconnConn) State() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+/**
+ * Conn returns the current conn, nil while not connected
+ */
+func (r *ReconnConn) Conn() ConnOp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.c
+}
+
+func (r *ReconnConn) setState(state int, c ConnOp, err error) {
+	r.mu.Lock()
+	r.state = state
+	r.c = c
+	r.mu.Unlock()
+	if r.OnStateChange != nil {
+		r.OnStateChange(state, err)
+	}
+}
+
+/**
+ * Run connects and moves data between rx / tx and the current conn until ctx is done
+ * or the attempts are exhausted, in which case it returns ErrGiveUp. rx is closed on return.
+ * Buffers taken from tx while a conn is failing are released, not retried.
+ */
+func (r *ReconnConn) Run(ctx context.Context, rx chan *Buffer, tx chan *Buffer) error {
+	defer close(rx)
+	attempt := 0
+	for {
+		c, err := r.connect(ctx, &attempt)
+		if err != nil {
+			r.setState(STATE_CLOSED, nil, err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		r.setState(STATE_CONNECTED, c, nil)
+		alive, err := r.serve(ctx, c, rx, tx)
+		if ctx.Err() != nil {
+			r.setState(STATE_CLOSED, nil, nil)
+			return nil
+		}
+		// a conn that never delivered anything counts as a failed attempt,
+		// so a peer that accepts and drops right away still backs off
+		if alive {
+			attempt = 0
+		}
+		r.setState(STATE_DISCONNECTED, nil, err)
+	}
+}
+
+func (r *ReconnConn) connect(ctx context.Context, attempt *int) (ConnOp, error) {
+	for {
+		if r.Backoff.MaxAttempts > 0 && *attempt >= r.Backoff.MaxAttempts {
+			return nil, ErrGiveUp
+		}
+		if *attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(r.Backoff.Delay(*attempt - 1)):
+			}
+		}
+		*attempt++
+
+		r.setState(STATE_CONNECTING, nil, nil)
+		c := r.Dial()
+		cctx, cancel := context.WithTimeout(ctx, r.ConnectTimeout)
+		err := c.Connect(cctx)
+		cancel()
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		ulog.Log().I("reconnect", "connect failed: "+err.Error())
+	}
+}
+
+/**
+ * serve runs one conn until it is lost, it reports whether any data came in
+ */
+func (r *ReconnConn) serve(ctx context.Context, c ConnOp, rx chan *Buffer, tx chan *Buffer) (bool, error) {
+	alive := false
+	innerRx := make(chan *Buffer)
+	if err := c.StartRecv(ctx, innerRx); err != nil {
+		c.Close()
+		return alive, err
+	}
+	if err := c.StartWrite(ctx, tx); err != nil {
+		c.Close()
+		return alive, err
+	}
+
+	for buff := range innerRx {
+		alive = true
+		select {
+		case rx <- buff:
+		case <-ctx.Done():
+			buff.Release()
+		}
+	}
+	c.Close()
+	return alive, c.Err()
+}
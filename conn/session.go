@@ -0,0 +1,183 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+var errIdle = errors.New("no data received within the idle timeout")
+
+/**
+ * Session is an accepted conn tracked by a SessionManager
+ */
+type Session struct {
+	Id        uint64
+	C         ConnOp
+	CreatedAt time.Time
+
+	idle bool
+}
+
+/**
+ * SessionManager tracks the conns accepted by a listener, closes the ones idle for longer than
+ * IdleTimeout and fires OnConnect / OnDisconnect once per session.
+ * The hooks run outside the manager lock, OnDisconnect always after OnConnect returned.
+ * The zero value is ready to use, without an idle timeout.
+ */
+type SessionManager struct {
+	// IdleTimeout closes a session that received nothing for that long, 0 disables it
+	IdleTimeout  time.Duration
+	OnConnect    func(s *Session)
+	OnDisconnect func(s *Session, err error)
+
+	mu       sync.Mutex
+	sessions map[uint64]*Session
+	nextId   uint64
+	wg       sync.WaitGroup
+}
+
+func NewSessionManager(idleTimeout time.Duration) *SessionManager {
+	return &SessionManager{
+		IdleTimeout: idleTimeout,
+		sessions:    make(map[uint64]*Session),
+	}
+}
+
+/**
+ * Serve accepts on l until ctx is done and runs handle for every new session in its own goroutine.
+ * It returns once the listener stopped and every session ended.
+ */
+func (m *SessionManager) Serve(ctx context.Context, l ConnOp, handle func(ctx context.Context, s *Session)) error {
+	chanC := make(chan ConnOp)
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- l.Accept(ctx, chanC)
+	}()
+
+	for c := range chanC {
+		s := m.Add(c)
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			handle(ctx, s)
+		}()
+	}
+	err := <-chanErr
+	m.CloseAll()
+	m.wg.Wait()
+	return err
+}
+
+/**
+ * Add starts tracking c, the session is dropped once c is done
+ */
+func (m *SessionManager) Add(c ConnOp) *Session {
+	m.mu.Lock()
+	if m.sessions == nil {
+		m.sessions = make(map[uint64]*Session)
+	}
+	m.nextId++
+	s := &Session{
+		Id:        m.nextId,
+		C:         c,
+		CreatedAt: time.Now(),
+	}
+	m.sessions[s.Id] = s
+	m.mu.Unlock()
+
+	if m.OnConnect != nil {
+		m.OnConnect(s)
+	}
+	m.wg.Add(1)
+	go m._taskWatch(s)
+	return s
+}
+
+/**
+ * _taskWatch closes the session when idle and removes it once its conn is done
+ */
+func (m *SessionManager) _taskWatch(s *Session) {
+	defer m.wg.Done()
+	var timeout <-chan time.Time
+	var timer *time.Timer
+	if m.IdleTimeout > 0 {
+		timer = time.NewTimer(m.IdleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-s.C.Done():
+			m.remove(s)
+			return
+		case <-timeout:
+			// sleep until the idle timeout counted from the last receive
+			idle := m.idleFor(s)
+			if idle < m.IdleTimeout {
+				timer.Reset(m.IdleTimeout - idle)
+				continue
+			}
+			m.mu.Lock()
+			s.idle = true
+			m.mu.Unlock()
+			s.C.Close()
+		}
+	}
+}
+
+func (m *SessionManager) idleFor(s *Session) time.Duration {
+	last := s.C.LastRecvAt()
+	if created := s.CreatedAt.UnixMicro(); last < created {
+		last = created
+	}
+	return time.Duration(utils.CurrentTimeInMicro()-last) * time.Microsecond
+}
+
+func (m *SessionManager) remove(s *Session) {
+	m.mu.Lock()
+	delete(m.sessions, s.Id)
+	idle := s.idle
+	m.mu.Unlock()
+
+	if m.OnDisconnect != nil {
+		err := s.C.Err()
+		if idle {
+			err = &ConnError{Kind: ErrTimeout, Err: errIdle}
+		}
+		m.OnDisconnect(s, err)
+	}
+}
+
+/**
+ * List returns the live sessions ordered by id
+ */
+func (m *SessionManager) List() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+func (m *SessionManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+func (m *SessionManager) CloseAll() {
+	for _, s := range m.List() {
+		s.C.Close()
+	}
+}
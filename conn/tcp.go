@@ -0,0 +1,207 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+type TcpConn struct {
+	BaseConn
+	// TLSConfig switches the conn to TLS over TCP, plaintext if nil, see TLSOptions
+	TLSConfig *tls.Config
+	Options   TcpOptions
+	c         net.Conn
+	raw       *net.TCPConn
+	l         *net.TCPListener
+}
+
+func NewTcpConn(addr string, port int) *TcpConn {
+	return &TcpConn{
+		BaseConn: BaseConn{
+			Addr: addr,
+			Port: port,
+		},
+		Options: DefaultTcpOptions(),
+	}
+}
+
+func (t *TcpConn) Accept(ctx context.Context, newC chan ConnOp) error {
+	defer close(newC)
+	addr := net.TCPAddr{
+		IP:   net.ParseIP(t.Addr),
+		Port: t.Port,
+	}
+	lc := net.ListenConfig{
+		KeepAlive: t.Options.KeepAlive,
+		Control:   t.Options.control,
+	}
+	ln, err := lc.Listen(ctx, "tcp", addr.String())
+	if err != nil {
+		ulog.Log().I("accept", "listen error: "+err.Error())
+		return err
+	}
+	l := ln.(*net.TCPListener)
+	t.l = l
+	t.closeOnCancel(ctx, t.Close)
+	var tlsConfig *tls.Config
+	if t.TLSConfig != nil {
+		tlsConfig = withALPN(t.TLSConfig, ALPN_TCP, "")
+	}
+
+	for {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if t.terminate(err) {
+				ulog.Log().I("accept", "accept error: "+err.Error())
+				l.Close()
+			}
+			return t.Err()
+		}
+
+		ulog.Log().I("accept", "new conn from "+c.RemoteAddr().String())
+		peer := &TcpConn{
+			BaseConn: BaseConn{
+				Addr:         c.RemoteAddr().(*net.TCPAddr).IP.String(),
+				Port:         c.RemoteAddr().(*net.TCPAddr).Port,
+				MaxFrameSize: t.MaxFrameSize,
+			},
+			Options: t.Options,
+			raw:     c,
+		}
+		peer.c, err = t.Options.wrap(c)
+		if err == nil {
+			err = t.Options.apply(c)
+		}
+		if err != nil {
+			ulog.Log().I("accept", "socket options error: "+err.Error())
+			c.Close()
+			continue
+		}
+		if tlsConfig != nil {
+			// the handshake runs on the first read of the recv task
+			peer.TLSConfig = t.TLSConfig
+			peer.c = tls.Server(peer.c, tlsConfig)
+		}
+		select {
+		case newC <- peer:
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+/**
+ * Connect dials the server and runs the TLS handshake if configured, ctx bounds both
+ */
+func (t *TcpConn) Connect(ctx context.Context) error {
+	d := net.Dialer{
+		KeepAlive: t.Options.KeepAlive,
+		Control:   t.Options.control,
+	}
+	nc, err := d.DialContext(ctx, "tcp", net.JoinHostPort(t.Addr, strconv.Itoa(t.Port)))
+	if err != nil {
+		return err
+	}
+	raw := nc.(*net.TCPConn)
+	c, err := t.Options.wrap(raw)
+	if err == nil {
+		err = t.Options.apply(raw)
+	}
+	if err != nil {
+		raw.Close()
+		return err
+	}
+	if t.TLSConfig != nil {
+		tc := tls.Client(c, withALPN(t.TLSConfig, ALPN_TCP, t.Addr))
+		if err = tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return err
+		}
+		c = tc
+	}
+	t.raw = raw
+	t.c = c
+	return nil
+}
+
+/**
+ * SocketInfo reports the socket options in effect on a connected conn
+ */
+func (t *TcpConn) SocketInfo() string {
+	if t.raw == nil {
+		return errNotConnected.Error()
+	}
+	return socketInfo(t.raw)
+}
+
+func (t *TcpConn) Close() error {
+	t.terminate(ErrClosed)
+	return t.release(func() error {
+		if t.l != nil {
+			return t.l.Close()
+		}
+		if t.c != nil {
+			return t.c.Close()
+		}
+		return nil
+	})
+}
+
+func (t *TcpConn) _taskRecv(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	fr := NewFrameReader(t.c, t.MaxFrameSize)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			// the stream cannot be resynchronized after a broken frame
+			if t.terminate(err) {
+				if isClosed(t.Err()) {
+					ulog.Log().I("tcp_recv", "connection closed: "+err.Error())
+				} else {
+					ulog.Log().I("tcp_recv", "read error: "+err.Error())
+				}
+			}
+			t.Close()
+			return
+		}
+		if !t.deliver(ctx, rx, frame) {
+			return
+		}
+	}
+}
+
+func (t *TcpConn) StartRecv(ctx context.Context, rx chan *Buffer) error {
+	if t.c == nil {
+		return errNotConnected
+	}
+	t.closeOnCancel(ctx, t.Close)
+	go t._taskRecv(ctx, rx)
+	return nil
+}
+
+func (t *TcpConn) StartWrite(ctx context.Context, tx chan *Buffer) error {
+	if t.c == nil {
+		return errNotConnected
+	}
+	t.setTxChan(tx)
+	t.closeOnCancel(ctx, t.Close)
+	go t._task_write(ctx, "tcp_write", tx, t.InstantWrite, t.Close)
+	return nil
+}
+
+func (t *TcpConn) InstantWrite(data []byte) error {
+	if t.c == nil {
+		return errNotConnected
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return classify(WriteFrame(t.c, data, t.MaxFrameSize))
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package conn
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * control sets the options that must be in place before connect / listen, for net.Dialer and net.ListenConfig
+ */
+func (o TcpOptions) control(network, address string, rc syscall.RawConn) error {
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		if o.ReadBuffer > 0 {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReadBuffer); err != nil {
+				return
+			}
+		}
+		if o.WriteBuffer > 0 {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, o.WriteBuffer); err != nil {
+				return
+			}
+		}
+		if o.UserTimeout > 0 {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds()))
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+/**
+ * wrap returns the conn to read and write through, which re-arms TCP_QUICKACK after every read:
+ * the kernel leaves quickack mode on its own, so setting it once does not last
+ */
+func (o TcpOptions) wrap(c *net.TCPConn) (net.Conn, error) {
+	if !o.QuickAck {
+		return c, nil
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	q := &quickAckConn{TCPConn: c, rc: rc}
+	return q, q.arm()
+}
+
+type quickAckConn struct {
+	*net.TCPConn
+	rc syscall.RawConn
+}
+
+func (q *quickAckConn) arm() error {
+	var err error
+	cerr := q.rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_QUICKACK, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (q *quickAckConn) Read(b []byte) (int, error) {
+	n, err := q.TCPConn.Read(b)
+	if err == nil {
+		q.arm()
+	}
+	return n, err
+}
+
+/**
+ * socketInfo reads the effective options back from the socket, the kernel doubles the buffer sizes asked for
+ */
+func socketInfo(c *net.TCPConn) string {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err.Error()
+	}
+	var info string
+	rc.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			v, err := unix.GetsockoptInt(int(fd), level, opt)
+			if err != nil {
+				return -1
+			}
+			return v
+		}
+		info = fmt.Sprintf("nodelay = %d, rcvbuf = %d, sndbuf = %d, keepalive = %d, keepidle = %d s, quickack = %d, user_timeout = %d ms",
+			get(unix.IPPROTO_TCP, unix.TCP_NODELAY),
+			get(unix.SOL_SOCKET, unix.SO_RCVBUF),
+			get(unix.SOL_SOCKET, unix.SO_SNDBUF),
+			get(unix.SOL_SOCKET, unix.SO_KEEPALIVE),
+			get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE),
+			get(unix.IPPROTO_TCP, unix.TCP_QUICKACK),
+			get(unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT))
+	})
+	return info
+}
@@ -0,0 +1,66 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var errUnsupportedOption = errors.New("tcp option not supported on this platform")
+
+/**
+ * TcpOptions are the socket options of a tcp conn, applied on the dialing side and to every accepted conn.
+ * The buffer sizes are set before connect / listen where the platform allows it, so they also shape the
+ * window negotiated in the handshake.
+ */
+type TcpOptions struct {
+	// NoDelay disables Nagle's algorithm, true by default in go
+	NoDelay bool
+	// ReadBuffer / WriteBuffer set SO_RCVBUF / SO_SNDBUF in bytes, 0 keeps the kernel default
+	ReadBuffer  int
+	WriteBuffer int
+	// KeepAlive is the keepalive period, 0 for the go default of 15 s, negative for off
+	KeepAlive time.Duration
+	// QuickAck sets TCP_QUICKACK after every read, linux only
+	QuickAck bool
+	// UserTimeout sets TCP_USER_TIMEOUT, how long sent data may stay unacknowledged, 0 for off, linux only
+	UserTimeout time.Duration
+}
+
+func DefaultTcpOptions() TcpOptions {
+	return TcpOptions{
+		NoDelay: true,
+	}
+}
+
+func (o TcpOptions) String() string {
+	keepAlive := "default"
+	if o.KeepAlive < 0 {
+		keepAlive = "off"
+	} else if o.KeepAlive > 0 {
+		keepAlive = o.KeepAlive.String()
+	}
+	return fmt.Sprintf("nodelay = %t, rcvbuf = %d, sndbuf = %d, keepalive = %s, quickack = %t, user_timeout = %s",
+		o.NoDelay, o.ReadBuffer, o.WriteBuffer, keepAlive, o.QuickAck, o.UserTimeout)
+}
+
+/**
+ * apply sets the options go exposes on a connected socket
+ */
+func (o TcpOptions) apply(c *net.TCPConn) error {
+	if err := c.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	if o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
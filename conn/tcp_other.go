@@ -0,0 +1,26 @@
+//go:build !linux
+
+package conn
+
+import (
+	"net"
+	"syscall"
+)
+
+func (o TcpOptions) control(network, address string, rc syscall.RawConn) error {
+	if o.QuickAck || o.UserTimeout > 0 {
+		return errUnsupportedOption
+	}
+	return nil
+}
+
+func (o TcpOptions) wrap(c *net.TCPConn) (net.Conn, error) {
+	return c, nil
+}
+
+/**
+ * socketInfo reads the effective options back on linux only
+ */
+func socketInfo(c *net.TCPConn) string {
+	return "effective options not available on this platform"
+}
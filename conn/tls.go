@@ -0,0 +1,124 @@
+package conn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const ALPN_QUIC = "ucs-quic"
+const ALPN_TCP = "ucs-tcp"
+
+/**
+ * TLSOptions locates the PEM files of a TLS endpoint, used by the tls tcp and quic conns.
+ * A server without CertFile serves a self-signed certificate, a server with CAFile requires
+ * client certificates signed by it (mTLS). A client verifies the server against CAFile,
+ * or the system roots if empty, and presents CertFile to a mTLS server.
+ */
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ServerName is the name verified in the server certificate, the dialed address if empty
+	ServerName string
+	// Insecure skips the verification of the server certificate, for testing only
+	Insecure bool
+}
+
+/**
+ * ServerConfig builds the listener side config of the options
+ */
+func (o TLSOptions) ServerConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if o.CertFile == "" {
+		cfg.Certificates = []tls.Certificate{selfSignedCert()}
+	} else {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load server certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+/**
+ * ClientConfig builds the dialing side config of the options
+ */
+func (o TLSOptions) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.Insecure,
+	}
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("load ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, errors.New("load ca: no certificate found in " + file)
+	}
+	return pool, nil
+}
+
+var selfSignedOnce sync.Once
+var selfSigned tls.Certificate
+
+/**
+ * selfSignedCert returns the certificate of a server without one, generated once per process
+ */
+func selfSignedCert() tls.Certificate {
+	selfSignedOnce.Do(func() {
+		ca, err := newCA()
+		if err != nil {
+			panic(err)
+		}
+		selfSigned, err = ca.issue("localhost", []string{"localhost", "127.0.0.1", "::1"}, false)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return selfSigned
+}
+
+/**
+ * withALPN returns a copy of cfg negotiating the given application protocol,
+ * a client config also gets the dialed host as ServerName unless it has one
+ */
+func withALPN(cfg *tls.Config, proto string, host string) *tls.Config {
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{proto}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	return cfg
+}
@@ -0,0 +1,416 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lingfliu.github.com/ucs_comm_test/ulog"
+	"lingfliu.github.com/ucs_comm_test/utils"
+)
+
+// largest payload a single udp datagram can carry
+const MAX_DATAGRAM_SIZE = 65507
+
+const DEFAULT_PEER_QUEUE_SIZE = 256
+const DEFAULT_PEER_IDLE_TIMEOUT = 30 * time.Second
+
+/**
+ * packetConn is what UdpConn needs of a datagram socket, met by both *net.UDPConn and *net.UnixConn
+ */
+type packetConn interface {
+	net.Conn
+	net.PacketConn
+}
+
+type UdpConn struct {
+	BaseConn
+	// network is PROTO_UDP, or PROTO_UNIXGRAM for a conn made by NewUnixgramConn
+	network    string
+	c          packetConn
+	remoteAddr net.Addr
+	// local socket file of a unixgram conn, removed on close
+	localPath string
+	// Multicast makes the conn one-to-many, see MulticastOptions
+	Multicast *MulticastOptions
+	// the socket a multicast listener replies from, so the responders of a host are told apart
+	replyC packetConn
+
+	// listener side: Accept demultiplexes the datagrams onto one peer per remote address
+	// PeerQueueSize bounds the datagrams queued per peer, the overflow is dropped
+	PeerQueueSize int
+	// PeerIdleTimeout evicts a peer that sent nothing for that long
+	PeerIdleTimeout time.Duration
+	peersMu         sync.Mutex
+	peers           map[string]*UdpConn
+	totalDrops      atomic.Uint64
+
+	// peer side
+	srv   *UdpConn
+	queue chan *Buffer
+	drops atomic.Uint64
+	evict *time.Timer
+}
+
+func NewUdpConn(addr string, port int) *UdpConn {
+	return &UdpConn{
+		BaseConn: BaseConn{
+			Addr: addr,
+			Port: port,
+		},
+		network:         PROTO_UDP,
+		PeerQueueSize:   DEFAULT_PEER_QUEUE_SIZE,
+		PeerIdleTimeout: DEFAULT_PEER_IDLE_TIMEOUT,
+	}
+}
+
+func (u *UdpConn) RemoteAddr() string {
+	if u.network == PROTO_UNIXGRAM {
+		return u.Addr
+	}
+	return u.BaseConn.RemoteAddr()
+}
+
+func (u *UdpConn) Accept(ctx context.Context, newC chan ConnOp) error {
+	defer close(newC)
+	l, err := u.listen()
+	if err != nil {
+		ulog.Log().I("udp_accept", "listen error: "+err.Error())
+		return err
+	}
+	u.c = l
+	u.peersMu.Lock()
+	u.peers = make(map[string]*UdpConn)
+	u.peersMu.Unlock()
+	u.closeOnCancel(ctx, u.Close)
+	return u.serve(ctx, "udp_accept", newC)
+}
+
+/**
+ * serve demultiplexes the datagrams read from u.c onto one peer per remote address until u.c is closed
+ */
+func (u *UdpConn) serve(ctx context.Context, tag string, newC chan ConnOp) error {
+	defer func() {
+		// the peers share the listening socket and cannot outlive it
+		for _, p := range u.Peers() {
+			p.Close()
+		}
+	}()
+
+	// read into one scratch buffer, a queued datagram holds a buffer of its own size only
+	scratch := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, clientAddr, err := u.c.ReadFrom(scratch)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				if u.terminate(err) {
+					ulog.Log().I(tag, "listener closed, stopping accept")
+				}
+				return u.Err()
+			}
+			// e.g. an icmp port unreachable left by a gone client, the listener itself is fine
+			ulog.Log().I(tag, "read error: "+err.Error())
+			continue
+		}
+		buff := AcquireBuffer(n)
+		copy(buff.Bytes(), scratch[:n])
+
+		p, isNew := u.peer(clientAddr)
+		if isNew {
+			ulog.Log().I(tag, "new client from "+clientAddr.String())
+			select {
+			case newC <- p:
+			case <-ctx.Done():
+				buff.Release()
+				return ctx.Err()
+			}
+		}
+		p.enqueue(buff)
+	}
+}
+
+func (u *UdpConn) listen() (packetConn, error) {
+	if u.Multicast != nil {
+		return u.listenGroup()
+	}
+	if u.network == PROTO_UNIXGRAM {
+		if err := removeStale(PROTO_UNIXGRAM, u.Addr); err != nil {
+			return nil, err
+		}
+		u.localPath = u.Addr
+		return net.ListenUnixgram(PROTO_UNIXGRAM, &net.UnixAddr{Name: u.Addr, Net: PROTO_UNIXGRAM})
+	}
+	addr := net.UDPAddr{
+		IP:   nil, // Listen on all interfaces
+		Port: u.Port,
+	}
+	if u.Addr != "" {
+		addr.IP = net.ParseIP(u.Addr)
+	}
+	return net.ListenUDP("udp", &addr)
+}
+
+/**
+ * peer returns the peer of a remote address, creating it on its first datagram
+ */
+func (u *UdpConn) peer(addr net.Addr) (*UdpConn, bool) {
+	key := addr.String()
+	u.peersMu.Lock()
+	defer u.peersMu.Unlock()
+	if p, ok := u.peers[key]; ok {
+		return p, false
+	}
+
+	size := u.PeerQueueSize
+	if size <= 0 {
+		size = DEFAULT_PEER_QUEUE_SIZE
+	}
+	c := u.c
+	if u.replyC != nil {
+		c = u.replyC
+	}
+	p := &UdpConn{
+		network:    u.network,
+		c:          c,
+		remoteAddr: addr,
+		srv:        u,
+		queue:      make(chan *Buffer, size),
+	}
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		p.Addr = a.IP.String()
+		p.Port = a.Port
+	case *net.UnixAddr:
+		p.Addr = a.Name
+	}
+	u.peers[key] = p
+	if u.PeerIdleTimeout > 0 {
+		p.evict = time.AfterFunc(u.PeerIdleTimeout, p._taskEvict)
+	}
+	return p, true
+}
+
+func (u *UdpConn) removePeer(p *UdpConn) {
+	u.peersMu.Lock()
+	defer u.peersMu.Unlock()
+	key := p.remoteAddr.String()
+	if u.peers[key] == p {
+		delete(u.peers, key)
+	}
+}
+
+/**
+ * Peers returns the live peers of a listening conn
+ */
+func (u *UdpConn) Peers() []*UdpConn {
+	u.peersMu.Lock()
+	defer u.peersMu.Unlock()
+	list := make([]*UdpConn, 0, len(u.peers))
+	for _, p := range u.peers {
+		list = append(list, p)
+	}
+	return list
+}
+
+/**
+ * Drops counts the datagrams dropped on a full peer queue:
+ * of this peer for a peer, of every peer so far for a listener
+ */
+func (u *UdpConn) Drops() uint64 {
+	if u.srv == nil {
+		return u.totalDrops.Load()
+	}
+	return u.drops.Load()
+}
+
+/**
+ * enqueue hands a datagram to the peer without ever blocking the listener
+ */
+func (u *UdpConn) enqueue(buff *Buffer) {
+	u.touch()
+	select {
+	case <-u.Done():
+		buff.Release()
+		return
+	default:
+	}
+	select {
+	case u.queue <- buff:
+	default:
+		buff.Release()
+		u.drops.Add(1)
+		u.srv.totalDrops.Add(1)
+	}
+}
+
+/**
+ * _taskEvict closes the peer once it has been idle for PeerIdleTimeout, or waits for the rest of it
+ */
+func (u *UdpConn) _taskEvict() {
+	timeout := u.srv.PeerIdleTimeout
+	idle := time.Duration(utils.CurrentTimeInMicro()-u.LastRecvAt()) * time.Microsecond
+	if idle < timeout {
+		u.evict.Reset(timeout - idle)
+		return
+	}
+	if u.terminate(&ConnError{Kind: ErrTimeout, Err: errIdle}) {
+		ulog.Log().I("udp_accept", fmt.Sprintf("evict idle client %s, dropped %d datagrams", u.RemoteAddr(), u.drops.Load()))
+	}
+	u.Close()
+}
+
+/**
+ * Connect binds a connected udp socket, ctx only bounds the dial
+ */
+func (u *UdpConn) Connect(ctx context.Context) error {
+	if u.network == PROTO_UNIXGRAM {
+		return u.connectUnixgram()
+	}
+	if u.Multicast != nil {
+		return u.connectGroup()
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", net.JoinHostPort(u.Addr, strconv.Itoa(u.Port)))
+	if err != nil {
+		return err
+	}
+	u.c = c.(*net.UDPConn)
+	// Don't set remoteAddr for client - this is only for server-side client tracking
+	return nil
+}
+
+func (u *UdpConn) Close() error {
+	u.terminate(ErrClosed)
+	if u.srv != nil {
+		// Server side peer shares the listening socket, it only leaves the demultiplexer
+		return u.release(func() error {
+			if u.evict != nil {
+				u.evict.Stop()
+			}
+			u.srv.removePeer(u)
+			return nil
+		})
+	}
+	return u.release(func() error {
+		if u.localPath != "" {
+			defer os.Remove(u.localPath)
+		}
+		if u.replyC != nil {
+			u.replyC.Close()
+		}
+		if u.c != nil {
+			err := u.c.Close()
+			if err != nil {
+				ulog.Log().I("udp_close", "close error: "+err.Error())
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (u *UdpConn) _taskRecv(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	scratch := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		// Client mode - read directly from connection
+		n, err := u.c.Read(scratch)
+
+		if err != nil {
+			if u.terminate(err) {
+				if isClosed(u.Err()) {
+					ulog.Log().I("udp_recv", "connection closed, stopping receive")
+				} else {
+					ulog.Log().I("udp_recv", "read error: "+err.Error())
+				}
+			}
+			u.Close()
+			return
+		}
+		buff := AcquireBuffer(n)
+		copy(buff.Bytes(), scratch[:n])
+		if !u.deliver(ctx, rx, buff) {
+			return
+		}
+	}
+}
+
+/**
+ * _taskRecvPeer moves the datagrams queued by Accept to rx until the peer finishes
+ */
+func (u *UdpConn) _taskRecvPeer(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	defer u.drain()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.Done():
+			return
+		case buff := <-u.queue:
+			if !u.deliver(ctx, rx, buff) {
+				return
+			}
+		}
+	}
+}
+
+/**
+ * drain releases what is left in a finished peer's queue
+ */
+func (u *UdpConn) drain() {
+	for {
+		select {
+		case buff := <-u.queue:
+			buff.Release()
+		default:
+			return
+		}
+	}
+}
+
+func (u *UdpConn) StartRecv(ctx context.Context, rx chan *Buffer) error {
+	if u.c == nil {
+		return errNotConnected
+	}
+	u.closeOnCancel(ctx, u.Close)
+	if u.srv != nil {
+		// Server mode - the datagrams are read in Accept()
+		go u._taskRecvPeer(ctx, rx)
+		return nil
+	}
+	go u._taskRecv(ctx, rx)
+	return nil
+}
+
+func (u *UdpConn) StartWrite(ctx context.Context, tx chan *Buffer) error {
+	if u.c == nil {
+		return errNotConnected
+	}
+	u.setTxChan(tx)
+	u.closeOnCancel(ctx, u.Close)
+	go u._task_write(ctx, "udp_write", tx, u.InstantWrite, u.Close)
+	return nil
+}
+
+func (u *UdpConn) InstantWrite(data []byte) error {
+	if u.c == nil {
+		return errNotConnected
+	}
+	var err error
+	if u.remoteAddr != nil {
+		_, err = u.c.WriteTo(data, u.remoteAddr)
+	} else {
+		_, err = u.c.Write(data)
+	}
+	return classify(err)
+}
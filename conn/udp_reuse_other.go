@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package conn
+
+import (
+	"syscall"
+)
+
+/**
+ * reuseControl binds the multicast port exclusively, one responder per host
+ */
+func reuseControl(network, address string, rc syscall.RawConn) error {
+	return nil
+}
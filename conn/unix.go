@@ -0,0 +1,233 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+/**
+ * UnixSocketPath is the socket file of a unix conn given a port instead of a path,
+ * so the port flags of the bench keep picking the endpoint
+ */
+func UnixSocketPath(port int) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ucs_%d.sock", port))
+}
+
+/**
+ * unixPath takes addr as the socket file if it has a directory, otherwise derives it from port
+ */
+func unixPath(addr string, port int) string {
+	if strings.ContainsAny(addr, `/\`) {
+		return addr
+	}
+	return UnixSocketPath(port)
+}
+
+/**
+ * removeStale removes the socket file left at path by a server that did not shut down,
+ * it fails if a server still answers there
+ */
+func removeStale(network string, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	c, err := net.Dial(network, path)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// numbers the accepted unix conns, which have no remote address of their own
+var unixPeerSeq atomic.Uint64
+
+/**
+ * UnixConn is a stream unix domain socket, framed like TcpConn, for a baseline without the network stack
+ */
+type UnixConn struct {
+	BaseConn
+	// Path of the socket file, Addr is unused
+	Path string
+	c    *net.UnixConn
+	l    *net.UnixListener
+	seq  uint64
+}
+
+func NewUnixConn(path string) *UnixConn {
+	return &UnixConn{
+		BaseConn: BaseConn{
+			Addr: path,
+		},
+		Path: path,
+	}
+}
+
+func (u *UnixConn) RemoteAddr() string {
+	if u.seq > 0 {
+		return fmt.Sprintf("%s#%d", u.Path, u.seq)
+	}
+	return u.Path
+}
+
+func (u *UnixConn) Accept(ctx context.Context, newC chan ConnOp) error {
+	defer close(newC)
+	if err := removeStale(PROTO_UNIX, u.Path); err != nil {
+		ulog.Log().I("unix_accept", "listen error: "+err.Error())
+		return err
+	}
+	// the listener removes the socket file on close
+	l, err := net.ListenUnix(PROTO_UNIX, &net.UnixAddr{Name: u.Path, Net: PROTO_UNIX})
+	if err != nil {
+		ulog.Log().I("unix_accept", "listen error: "+err.Error())
+		return err
+	}
+	u.l = l
+	u.closeOnCancel(ctx, u.Close)
+
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if u.terminate(err) {
+				ulog.Log().I("unix_accept", "accept error: "+err.Error())
+				l.Close()
+			}
+			return u.Err()
+		}
+
+		peer := &UnixConn{
+			BaseConn: BaseConn{
+				Addr:         u.Path,
+				MaxFrameSize: u.MaxFrameSize,
+			},
+			Path: u.Path,
+			c:    c,
+			seq:  unixPeerSeq.Add(1),
+		}
+		ulog.Log().I("unix_accept", "new conn "+peer.RemoteAddr())
+		select {
+		case newC <- peer:
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+/**
+ * Connect dials the socket file, ctx only bounds the dial
+ */
+func (u *UnixConn) Connect(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, PROTO_UNIX, u.Path)
+	if err != nil {
+		return err
+	}
+	u.c = c.(*net.UnixConn)
+	return nil
+}
+
+func (u *UnixConn) Close() error {
+	u.terminate(ErrClosed)
+	return u.release(func() error {
+		if u.l != nil {
+			return u.l.Close()
+		}
+		if u.c != nil {
+			return u.c.Close()
+		}
+		return nil
+	})
+}
+
+func (u *UnixConn) _taskRecv(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	fr := NewFrameReader(u.c, u.MaxFrameSize)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			if u.terminate(err) {
+				if isClosed(u.Err()) {
+					ulog.Log().I("unix_recv", "connection closed: "+err.Error())
+				} else {
+					ulog.Log().I("unix_recv", "read error: "+err.Error())
+				}
+			}
+			u.Close()
+			return
+		}
+		if !u.deliver(ctx, rx, frame) {
+			return
+		}
+	}
+}
+
+func (u *UnixConn) StartRecv(ctx context.Context, rx chan *Buffer) error {
+	if u.c == nil {
+		return errNotConnected
+	}
+	u.closeOnCancel(ctx, u.Close)
+	go u._taskRecv(ctx, rx)
+	return nil
+}
+
+func (u *UnixConn) StartWrite(ctx context.Context, tx chan *Buffer) error {
+	if u.c == nil {
+		return errNotConnected
+	}
+	u.setTxChan(tx)
+	u.closeOnCancel(ctx, u.Close)
+	go u._task_write(ctx, "unix_write", tx, u.InstantWrite, u.Close)
+	return nil
+}
+
+func (u *UnixConn) InstantWrite(data []byte) error {
+	if u.c == nil {
+		return errNotConnected
+	}
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	return classify(WriteFrame(u.c, data, u.MaxFrameSize))
+}
+
+// numbers the local socket files of the unixgram clients of this process
+var unixgramClientSeq atomic.Uint64
+
+/**
+ * NewUnixgramConn creates a datagram unix domain socket conn. It is a UdpConn over a socket file,
+ * so the listener demultiplexes its clients and queues their datagrams the same way.
+ */
+func NewUnixgramConn(path string) *UdpConn {
+	u := NewUdpConn(path, 0)
+	u.network = PROTO_UNIXGRAM
+	return u
+}
+
+/**
+ * connectUnixgram binds the client to a socket file of its own, without which the server cannot answer
+ */
+func (u *UdpConn) connectUnixgram() error {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("ucs_cli_%d_%d.sock", os.Getpid(), unixgramClientSeq.Add(1)))
+	os.Remove(local)
+	c, err := net.DialUnix(PROTO_UNIXGRAM,
+		&net.UnixAddr{Name: local, Net: PROTO_UNIXGRAM},
+		&net.UnixAddr{Name: u.Addr, Net: PROTO_UNIXGRAM})
+	if err != nil {
+		os.Remove(local)
+		return err
+	}
+	u.c = c
+	u.localPath = local
+	return nil
+}
@@ -0,0 +1,230 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/websocket"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+const DEFAULT_WS_PATH = "/ucs"
+
+/**
+ * WsConn carries every message in one binary websocket frame, over http or https when TLSConfig is set
+ */
+type WsConn struct {
+	BaseConn
+	// TLSConfig switches to wss, see TLSOptions
+	TLSConfig *tls.Config
+	// Path of the websocket endpoint, DEFAULT_WS_PATH if empty
+	Path string
+	c    *websocket.Conn
+	srv  *http.Server
+}
+
+func NewWsConn(addr string, port int) *WsConn {
+	return &WsConn{
+		BaseConn: BaseConn{
+			Addr: addr,
+			Port: port,
+		},
+		Path: DEFAULT_WS_PATH,
+	}
+}
+
+func (w *WsConn) path() string {
+	if w.Path == "" {
+		return DEFAULT_WS_PATH
+	}
+	return w.Path
+}
+
+func (w *WsConn) Accept(ctx context.Context, newC chan ConnOp) error {
+	defer close(newC)
+	addr := net.JoinHostPort(w.Addr, strconv.Itoa(w.Port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ulog.Log().I("ws_accept", "listen error: "+err.Error())
+		return err
+	}
+	if w.TLSConfig != nil {
+		ln = tls.NewListener(ln, withALPN(w.TLSConfig, "http/1.1", ""))
+	}
+
+	// handlers hand their peer off until the server stopped, newC is closed only after all of them returned
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stopped := false
+	done := make(chan struct{})
+	defer func() {
+		mu.Lock()
+		stopped = true
+		close(done)
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	// the http server runs every websocket in a handler of its own, which must not return before the conn is done
+	handler := func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		ws.MaxPayloadBytes = w.maxFrameSize()
+		remote, _ := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+		ulog.Log().I("ws_accept", "new conn from "+ws.Request().RemoteAddr)
+		peer := &WsConn{
+			BaseConn: BaseConn{
+				MaxFrameSize: w.MaxFrameSize,
+			},
+			c: ws,
+		}
+		if remote != nil {
+			peer.Addr = remote.IP.String()
+			peer.Port = remote.Port
+		}
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			peer.Close()
+			return
+		}
+		wg.Add(1)
+		mu.Unlock()
+		handed := false
+		select {
+		case newC <- peer:
+			handed = true
+		case <-ctx.Done():
+		case <-done:
+		}
+		wg.Done()
+		if !handed {
+			// nobody takes the peer once the server stopped
+			peer.Close()
+			return
+		}
+		<-peer.Done()
+	}
+	mux := http.NewServeMux()
+	// a nil Handshake accepts any origin, the clients are not browsers
+	mux.Handle(w.path(), websocket.Server{Handler: handler})
+	w.srv = &http.Server{Handler: mux}
+	w.closeOnCancel(ctx, w.Close)
+
+	err = w.srv.Serve(ln)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if w.terminate(err) && !errors.Is(err, http.ErrServerClosed) {
+		ulog.Log().I("ws_accept", "serve error: "+err.Error())
+	}
+	return w.Err()
+}
+
+/**
+ * Connect dials the server and runs the websocket upgrade, ctx only bounds the dial
+ */
+func (w *WsConn) Connect(ctx context.Context) error {
+	scheme := "ws"
+	origin := "http"
+	if w.TLSConfig != nil {
+		scheme = "wss"
+		origin = "https"
+	}
+	host := net.JoinHostPort(w.Addr, strconv.Itoa(w.Port))
+	cfg, err := websocket.NewConfig(scheme+"://"+host+w.path(), origin+"://"+host+"/")
+	if err != nil {
+		return err
+	}
+	if w.TLSConfig != nil {
+		cfg.TlsConfig = withALPN(w.TLSConfig, "http/1.1", w.Addr)
+	}
+	ws, err := cfg.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = w.maxFrameSize()
+	w.c = ws
+	return nil
+}
+
+func (w *WsConn) maxFrameSize() int {
+	if w.MaxFrameSize > 0 {
+		return w.MaxFrameSize
+	}
+	return DEFAULT_MAX_FRAME_SIZE
+}
+
+func (w *WsConn) Close() error {
+	w.terminate(ErrClosed)
+	return w.release(func() error {
+		if w.srv != nil {
+			return w.srv.Close()
+		}
+		if w.c != nil {
+			return w.c.Close()
+		}
+		return nil
+	})
+}
+
+func (w *WsConn) _taskRecv(ctx context.Context, rx chan *Buffer) {
+	defer close(rx)
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(w.c, &msg)
+		if err != nil {
+			if w.terminate(err) {
+				if isClosed(w.Err()) {
+					ulog.Log().I("ws_recv", "connection closed: "+err.Error())
+				} else {
+					ulog.Log().I("ws_recv", "read error: "+err.Error())
+				}
+			}
+			w.Close()
+			return
+		}
+		if !w.deliver(ctx, rx, WrapBuffer(msg)) {
+			return
+		}
+	}
+}
+
+func (w *WsConn) StartRecv(ctx context.Context, rx chan *Buffer) error {
+	if w.c == nil {
+		return errNotConnected
+	}
+	w.closeOnCancel(ctx, w.Close)
+	go w._taskRecv(ctx, rx)
+	return nil
+}
+
+func (w *WsConn) StartWrite(ctx context.Context, tx chan *Buffer) error {
+	if w.c == nil {
+		return errNotConnected
+	}
+	w.setTxChan(tx)
+	w.closeOnCancel(ctx, w.Close)
+	go w._task_write(ctx, "ws_write", tx, w.InstantWrite, w.Close)
+	return nil
+}
+
+/**
+ * InstantWrite sends data as one binary frame
+ */
+func (w *WsConn) InstantWrite(data []byte) error {
+	if w.c == nil {
+		return errNotConnected
+	}
+	if len(data) > w.maxFrameSize() {
+		return ErrFrameTooLarge
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return classify(websocket.Message.Send(w.c, data))
+}
@@ -1,7 +1,343 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"lingfliu.github.com/ucs_comm_test/bench"
+	"lingfliu.github.com/ucs_comm_test/conn"
+	"lingfliu.github.com/ucs_comm_test/stats"
+	"lingfliu.github.com/ucs_comm_test/ulog"
+)
+
+const usage = `usage: ucsbench <command> [flags]
+
+commands:
+  client    send pingpong packets and measure round trip latency
+  server    echo pingpong packets back to the client
+  handshake measure quic connect latency with 1-RTT and 0-RTT handshakes
+  hol       measure pingpong latency next to a bulk flow over tcp and quic
+  gencert   generate a local test CA with a server and a client certificate
+
+run 'ucsbench <command> -h' for the flags of a command
+`
 
 func main() {
-	fmt.Println("Hello, World!")
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "client":
+		err = runClient(ctx, os.Args[2:])
+	case "server":
+		err = runServer(ctx, os.Args[2:])
+	case "handshake":
+		err = runHandshake(ctx, os.Args[2:])
+	case "hol":
+		err = runHol(ctx, os.Args[2:])
+	case "gencert":
+		err = runGencert(os.Args[2:])
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+func runClient(ctx context.Context, args []string) error {
+	var cfg bench.ClientConfig
+	var logFile string
+	var backoffMs int
+	var statsInterval int
+	var lossDeadlineMs int
+	var socketPath string
+
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	fs.StringVar(&cfg.Proto, "proto", "tcp", "protocol: tcp | udp | quic | ws | unix | unixgram")
+	fs.StringVar(&cfg.Addr, "host_addr", "127.0.0.1", "host")
+	fs.IntVar(&cfg.Port, "host_port", 0, "port, defaults to the protocol's port")
+	fs.StringVar(&socketPath, "socket_path", "", "unix / unixgram: socket file, derived from host_port if empty")
+	fs.IntVar(&cfg.Fps, "fps", 10, "fps")
+	fs.IntVar(&cfg.PayloadSize, "payload_size", 0, "bytes of payload padding every pingpong")
+	fs.BoolVar(&cfg.CRC, "crc", false, "append a CRC-32C to every pingpong, checked by the server and on the echo")
+	fs.IntVar(&statsInterval, "stats_interval", int(bench.DEFAULT_STATS_INTERVAL.Seconds()), "log the latency distribution every that many seconds, 0 for the whole run only")
+	fs.IntVar(&lossDeadlineMs, "loss_deadline", int(stats.DEFAULT_LOSS_DEADLINE.Milliseconds()), "a pingpong not echoed within that many ms is lost, echoed later it is late")
+	fs.StringVar(&logFile, "log_file", "", "log_file, defaults to yyyymmdd_hhMMss_<proto>.log")
+	fs.BoolVar(&cfg.Reconnect, "reconnect", false, "reconnect with backoff when the connection is lost")
+	fs.IntVar(&cfg.Backoff.MaxAttempts, "reconnect_attempts", 0, "consecutive reconnect attempts before giving up, 0 for no limit")
+	fs.IntVar(&backoffMs, "reconnect_backoff", 100, "initial reconnect backoff in ms, doubled up to 10 s")
+	fs.BoolVar(&cfg.TLS, "tls", false, "tcp / ws: connect over TLS (wss for ws)")
+	fs.StringVar(&cfg.TLSOptions.CAFile, "ca_file", "", "tls / quic: CA verifying the server, the system roots if empty")
+	fs.BoolVar(&cfg.TLSOptions.Insecure, "insecure", false, "tls / quic: skip verifying the server certificate, for self-signed test servers")
+	fs.StringVar(&cfg.TLSOptions.CertFile, "cert_file", "", "tls / quic: client certificate for a server requiring one")
+	fs.StringVar(&cfg.TLSOptions.KeyFile, "key_file", "", "tls / quic: key of cert_file")
+	fs.StringVar(&cfg.TLSOptions.ServerName, "server_name", "", "tls / quic: name in the server certificate, defaults to host_addr")
+	fs.BoolVar(&cfg.ZeroRTT, "zero_rtt", false, "quic only: resume sessions with 0-RTT when reconnecting")
+	fs.BoolVar(&cfg.Datagram, "datagram", false, "quic only: send the pingpongs in unreliable DATAGRAM frames")
+	fs.IntVar(&cfg.Streams, "streams", 1, "quic only: parallel pingpong streams on one connection")
+	mc := conn.DefaultMulticastOptions("")
+	fs.StringVar(&mc.Group, "multicast_group", "", "udp only: send to this multicast or broadcast group on host_port, every responder replies")
+	fs.StringVar(&mc.Interface, "multicast_if", "", "udp only: interface to send the group on, by the routing table if empty")
+	fs.IntVar(&mc.TTL, "multicast_ttl", conn.DEFAULT_MULTICAST_TTL, "udp only: ttl of the group datagrams")
+	fs.BoolVar(&mc.Loopback, "multicast_loopback", true, "udp only: deliver the group datagrams to responders on this host too")
+	tf := addTcpFlags(fs)
+	qf := addQuicFlags(fs)
+	fs.Parse(args)
+	cfg.Tcp = tf.options()
+	cfg.Quic = qf.config()
+
+	if cfg.Port == 0 {
+		cfg.Port = bench.DefaultPort(cfg.Proto)
+	}
+	if socketPath != "" {
+		cfg.Addr = socketPath
+	}
+	if mc.Group != "" {
+		cfg.Multicast = &mc
+	}
+	if cfg.Fps <= 0 {
+		return fmt.Errorf("invalid fps: %d", cfg.Fps)
+	}
+	if cfg.PayloadSize < 0 {
+		return fmt.Errorf("invalid payload size: %d", cfg.PayloadSize)
+	}
+	cfg.StatsInterval = time.Duration(statsInterval) * time.Second
+	cfg.LossDeadline = time.Duration(lossDeadlineMs) * time.Millisecond
+	maxAttempts := cfg.Backoff.MaxAttempts
+	cfg.Backoff = conn.DefaultBackoff()
+	cfg.Backoff.Initial = time.Duration(backoffMs) * time.Millisecond
+	cfg.Backoff.MaxAttempts = maxAttempts
+	if logFile == "" {
+		logFile = fmt.Sprintf("%s_%s.log", time.Now().Format("20060102_150405"), cfg.Proto)
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	logPath := path.Join(dir, logFile)
+
+	if cfg.Proto == conn.PROTO_UNIX || cfg.Proto == conn.PROTO_UNIXGRAM {
+		if socketPath == "" {
+			socketPath = conn.UnixSocketPath(cfg.Port)
+		}
+		fmt.Print("connecting to ", socketPath, " over ", cfg.Proto, "\n")
+	} else {
+		if cfg.Multicast != nil {
+			cfg.Addr = cfg.Multicast.Group
+		}
+		fmt.Print("connecting to ", cfg.Addr, ":", cfg.Port, " over ", cfg.Proto, "\n")
+	}
+	fmt.Println("log_file: ", logPath)
+	ulog.Config(ulog.LOG_LEVEL_INFO, logPath, false)
+
+	return bench.RunClient(ctx, cfg)
+}
+
+func runServer(ctx context.Context, args []string) error {
+	var cfg bench.ServerConfig
+	var timeout int
+	var socketPath string
+
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	fs.StringVar(&cfg.Proto, "proto", "tcp", "protocol: tcp | udp | quic | ws | unix | unixgram")
+	fs.IntVar(&cfg.Port, "host_port", 0, "port, defaults to the protocol's port")
+	fs.StringVar(&socketPath, "socket_path", "", "unix / unixgram: socket file, derived from host_port if empty")
+	fs.IntVar(&timeout, "timeout", 10, "idle timeout of a client in seconds")
+	fs.IntVar(&cfg.PeerQueueSize, "peer_queue", conn.DEFAULT_PEER_QUEUE_SIZE, "udp / unixgram: datagrams queued per client before dropping")
+	fs.BoolVar(&cfg.TLS, "tls", false, "tcp / ws: serve over TLS (wss for ws)")
+	fs.StringVar(&cfg.TLSOptions.CertFile, "cert_file", "", "tls / quic: server certificate, self-signed if empty")
+	fs.StringVar(&cfg.TLSOptions.KeyFile, "key_file", "", "tls / quic: key of cert_file")
+	fs.StringVar(&cfg.TLSOptions.CAFile, "client_ca_file", "", "tls / quic: require client certificates signed by this CA (mTLS)")
+	fs.BoolVar(&cfg.ZeroRTT, "zero_rtt", false, "quic only: accept 0-RTT data of resuming clients")
+	fs.BoolVar(&cfg.Datagram, "datagram", false, "quic only: echo DATAGRAM frames instead of a stream")
+	mc := conn.DefaultMulticastOptions("")
+	fs.StringVar(&mc.Group, "multicast_group", "", "udp only: respond to this multicast or broadcast group on host_port")
+	fs.StringVar(&mc.Interface, "multicast_if", "", "udp only: interface to join the group on, by the routing table if empty")
+	tf := addTcpFlags(fs)
+	qf := addQuicFlags(fs)
+	fs.Parse(args)
+	cfg.Tcp = tf.options()
+	cfg.Quic = qf.config()
+
+	if cfg.Port == 0 {
+		cfg.Port = bench.DefaultPort(cfg.Proto)
+	}
+	cfg.Addr = socketPath
+	if mc.Group != "" {
+		cfg.Multicast = &mc
+	}
+	cfg.IdleTimeout = time.Duration(timeout) * time.Second
+
+	ulog.Config(ulog.LOG_LEVEL_INFO, "", false)
+
+	return bench.RunServer(ctx, cfg)
+}
+
+func runHandshake(ctx context.Context, args []string) error {
+	var cfg bench.HandshakeConfig
+	var intervalMs int
+
+	fs := flag.NewFlagSet("handshake", flag.ExitOnError)
+	fs.StringVar(&cfg.Addr, "host_addr", "127.0.0.1", "host")
+	fs.IntVar(&cfg.Port, "host_port", bench.DEFAULT_PORT_QUIC, "port")
+	fs.IntVar(&cfg.Count, "count", bench.DEFAULT_HANDSHAKE_COUNT, "connects per handshake mode")
+	fs.IntVar(&intervalMs, "interval", 100, "pause between two connects in ms")
+	fs.StringVar(&cfg.TLSOptions.CAFile, "ca_file", "", "CA verifying the server, the system roots if empty")
+	fs.BoolVar(&cfg.TLSOptions.Insecure, "insecure", false, "skip verifying the server certificate, for self-signed test servers")
+	fs.StringVar(&cfg.TLSOptions.CertFile, "cert_file", "", "client certificate for a server requiring one")
+	fs.StringVar(&cfg.TLSOptions.KeyFile, "key_file", "", "key of cert_file")
+	fs.StringVar(&cfg.TLSOptions.ServerName, "server_name", "", "name in the server certificate, defaults to host_addr")
+	qf := addQuicFlags(fs)
+	fs.Parse(args)
+	cfg.Quic = qf.config()
+
+	cfg.Interval = time.Duration(intervalMs) * time.Millisecond
+
+	ulog.Config(ulog.LOG_LEVEL_INFO, "", false)
+
+	return bench.RunHandshake(ctx, cfg)
+}
+
+func runHol(ctx context.Context, args []string) error {
+	var cfg bench.HolConfig
+	var duration int
+	var scenarios string
+
+	fs := flag.NewFlagSet("hol", flag.ExitOnError)
+	fs.StringVar(&cfg.Addr, "host_addr", "127.0.0.1", "host running a tcp and a quic server")
+	fs.IntVar(&cfg.TcpPort, "tcp_port", bench.DEFAULT_PORT_TCP, "port of the tcp server")
+	fs.IntVar(&cfg.QuicPort, "quic_port", bench.DEFAULT_PORT_QUIC, "port of the quic server")
+	fs.IntVar(&cfg.Fps, "fps", 100, "pingpongs per second")
+	fs.IntVar(&duration, "duration", 5, "duration of each scenario in seconds")
+	fs.IntVar(&cfg.BulkSize, "bulk_size", bench.DEFAULT_BULK_SIZE, "size of a bulk message in bytes")
+	fs.IntVar(&cfg.BulkRate, "bulk_rate", bench.DEFAULT_BULK_RATE, "bulk messages per second, 0 for as fast as possible")
+	fs.StringVar(&scenarios, "scenarios", "", "comma separated scenarios, all if empty: "+strings.Join(bench.HolScenarioNames(), ","))
+	fs.BoolVar(&cfg.TLS, "tls", false, "run the tcp scenarios over TLS")
+	fs.StringVar(&cfg.TLSOptions.CAFile, "ca_file", "", "CA verifying the servers, the system roots if empty")
+	fs.BoolVar(&cfg.TLSOptions.Insecure, "insecure", false, "skip verifying the server certificates, for self-signed test servers")
+	tf := addTcpFlags(fs)
+	qf := addQuicFlags(fs)
+	fs.Parse(args)
+	cfg.Tcp = tf.options()
+	cfg.Quic = qf.config()
+
+	if cfg.Fps <= 0 {
+		return fmt.Errorf("invalid fps: %d", cfg.Fps)
+	}
+	cfg.Duration = time.Duration(duration) * time.Second
+	if scenarios != "" {
+		cfg.Scenarios = strings.Split(scenarios, ",")
+	}
+
+	ulog.Config(ulog.LOG_LEVEL_INFO, "", false)
+
+	return bench.RunHol(ctx, cfg)
+}
+
+/**
+ * tcpFlags are the tcp socket option flags shared by the commands
+ */
+type tcpFlags struct {
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+	keepAlive   int
+	quickAck    bool
+	userTimeout int
+}
+
+func addTcpFlags(fs *flag.FlagSet) *tcpFlags {
+	f := &tcpFlags{}
+	fs.BoolVar(&f.noDelay, "tcp_nodelay", true, "tcp: disable Nagle's algorithm")
+	fs.IntVar(&f.readBuffer, "tcp_rcvbuf", 0, "tcp: socket receive buffer in bytes, 0 for the kernel default")
+	fs.IntVar(&f.writeBuffer, "tcp_sndbuf", 0, "tcp: socket send buffer in bytes, 0 for the kernel default")
+	fs.IntVar(&f.keepAlive, "tcp_keepalive", 0, "tcp: keepalive period in ms, 0 for 15 s, -1 for off")
+	fs.BoolVar(&f.quickAck, "tcp_quickack", false, "tcp: set TCP_QUICKACK after every read, linux only")
+	fs.IntVar(&f.userTimeout, "tcp_user_timeout", 0, "tcp: TCP_USER_TIMEOUT in ms, 0 for off, linux only")
+	return f
+}
+
+func (f *tcpFlags) options() *conn.TcpOptions {
+	return &conn.TcpOptions{
+		NoDelay:     f.noDelay,
+		ReadBuffer:  f.readBuffer,
+		WriteBuffer: f.writeBuffer,
+		KeepAlive:   time.Duration(f.keepAlive) * time.Millisecond,
+		QuickAck:    f.quickAck,
+		UserTimeout: time.Duration(f.userTimeout) * time.Millisecond,
+	}
+}
+
+/**
+ * quicFlags are the quic transport flags shared by the commands, 0 keeps the quic-go default
+ */
+type quicFlags struct {
+	idleTimeout     int
+	keepAlive       int
+	streamWindow    int
+	maxStreamWindow int
+	connWindow      int
+	maxConnWindow   int
+	maxStreams      int
+}
+
+func addQuicFlags(fs *flag.FlagSet) *quicFlags {
+	f := &quicFlags{}
+	fs.IntVar(&f.idleTimeout, "quic_idle_timeout", 0, "quic: idle timeout in ms, 0 for 30 s")
+	fs.IntVar(&f.keepAlive, "quic_keepalive", 0, "quic: keepalive period in ms, 0 for off")
+	fs.IntVar(&f.streamWindow, "quic_stream_window", 0, "quic: initial stream receive window in KB, 0 for 512")
+	fs.IntVar(&f.maxStreamWindow, "quic_max_stream_window", 0, "quic: max stream receive window in KB, 0 for 6144")
+	fs.IntVar(&f.connWindow, "quic_conn_window", 0, "quic: initial connection receive window in KB, 0 for 768")
+	fs.IntVar(&f.maxConnWindow, "quic_max_conn_window", 0, "quic: max connection receive window in KB, 0 for 15360")
+	fs.IntVar(&f.maxStreams, "quic_max_streams", 0, "quic: max incoming streams per connection, 0 for 100")
+	return f
+}
+
+func (f *quicFlags) config() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:                 time.Duration(f.idleTimeout) * time.Millisecond,
+		KeepAlivePeriod:                time.Duration(f.keepAlive) * time.Millisecond,
+		InitialStreamReceiveWindow:     uint64(f.streamWindow) << 10,
+		MaxStreamReceiveWindow:         uint64(f.maxStreamWindow) << 10,
+		InitialConnectionReceiveWindow: uint64(f.connWindow) << 10,
+		MaxConnectionReceiveWindow:     uint64(f.maxConnWindow) << 10,
+		MaxIncomingStreams:             int64(f.maxStreams),
+	}
+}
+
+func runGencert(args []string) error {
+	var dir string
+	var hosts string
+
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	fs.StringVar(&dir, "out", "certs", "output directory")
+	fs.StringVar(&hosts, "hosts", "localhost,127.0.0.1,::1", "comma separated names and ips of the server certificate")
+	fs.Parse(args)
+
+	files, err := conn.GenerateTestCerts(dir, strings.Split(hosts, ","))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Println("written", f)
+	}
+	return nil
 }
@@ -0,0 +1,166 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/**
+ * packet layout, all fields little-endian:
+ * bytes 0-1: magic "UC"
+ * byte 2: version
+ * byte 3: type, TYPE_
+ * bytes 4-5: flags, FLAG_
+ * bytes 6-7: reserved, sent as 0
+ * bytes 8-15: sequence number
+ * bytes 16-23: client send timestamp in ns
+ * bytes 24-31: server receive timestamp in ns, 0 until stamped
+ * bytes 32-39: server send timestamp in ns, 0 until stamped
+ * bytes 40-43: payload length
+ * bytes 44- : payload
+ * with FLAG_CRC, 4 more bytes: CRC-32C of everything before them
+ */
+const HEADER_LEN = 44
+const CRC_LEN = 4
+
+const MAGIC_0 = 'U'
+const MAGIC_1 = 'C'
+const VERSION = 1
+
+const (
+	TYPE_PINGPONG = 1
+	// filler of the hol test, echoed as is
+	TYPE_BULK = 2
+)
+
+const (
+	FLAG_CRC = 1 << iota
+	// the server timestamps are set
+	FLAG_STAMPED
+
+	FLAGS_KNOWN = FLAG_CRC | FLAG_STAMPED
+)
+
+var ErrShort = errors.New("packet shorter than its header")
+var ErrMagic = errors.New("bad packet magic")
+var ErrVersion = errors.New("unsupported packet version")
+var ErrType = errors.New("unknown packet type")
+var ErrFlags = errors.New("unknown packet flags")
+var ErrLength = errors.New("packet length mismatch")
+var ErrChecksum = errors.New("packet checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type Packet struct {
+	Type       uint8
+	Flags      uint16
+	Seq        uint64
+	ClientSend int64
+	ServerRecv int64
+	ServerSend int64
+	Payload    []byte
+}
+
+/**
+ * Len returns the encoded length of the packet
+ */
+func (p *Packet) Len() int {
+	n := HEADER_LEN + len(p.Payload)
+	if p.Flags&FLAG_CRC != 0 {
+		n += CRC_LEN
+	}
+	return n
+}
+
+/**
+ * Stamped reports whether the server put its timestamps into the packet
+ */
+func (p *Packet) Stamped() bool {
+	return p.Flags&FLAG_STAMPED != 0
+}
+
+/**
+ * Encode writes the packet into a new buffer
+ */
+func (p *Packet) Encode() []byte {
+	bs := make([]byte, p.Len())
+	bs[0] = MAGIC_0
+	bs[1] = MAGIC_1
+	bs[2] = VERSION
+	bs[3] = p.Type
+	binary.LittleEndian.PutUint16(bs[4:6], p.Flags)
+	binary.LittleEndian.PutUint64(bs[8:16], p.Seq)
+	binary.LittleEndian.PutUint64(bs[16:24], uint64(p.ClientSend))
+	binary.LittleEndian.PutUint64(bs[24:32], uint64(p.ServerRecv))
+	binary.LittleEndian.PutUint64(bs[32:40], uint64(p.ServerSend))
+	binary.LittleEndian.PutUint32(bs[40:44], uint32(len(p.Payload)))
+	copy(bs[HEADER_LEN:], p.Payload)
+	sum(bs, p.Flags)
+	return bs
+}
+
+/**
+ * Decode parses and checks a whole packet, the payload of the result points into bs
+ */
+func Decode(bs []byte) (*Packet, error) {
+	if len(bs) < HEADER_LEN {
+		return nil, fmt.Errorf("%w: %d bytes", ErrShort, len(bs))
+	}
+	if bs[0] != MAGIC_0 || bs[1] != MAGIC_1 {
+		return nil, fmt.Errorf("%w: %#02x%02x", ErrMagic, bs[0], bs[1])
+	}
+	if bs[2] != VERSION {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, bs[2])
+	}
+	p := &Packet{
+		Type:       bs[3],
+		Flags:      binary.LittleEndian.Uint16(bs[4:6]),
+		Seq:        binary.LittleEndian.Uint64(bs[8:16]),
+		ClientSend: int64(binary.LittleEndian.Uint64(bs[16:24])),
+		ServerRecv: int64(binary.LittleEndian.Uint64(bs[24:32])),
+		ServerSend: int64(binary.LittleEndian.Uint64(bs[32:40])),
+	}
+	if p.Type != TYPE_PINGPONG && p.Type != TYPE_BULK {
+		return nil, fmt.Errorf("%w: %d", ErrType, p.Type)
+	}
+	if p.Flags&^FLAGS_KNOWN != 0 {
+		return nil, fmt.Errorf("%w: %#04x", ErrFlags, p.Flags)
+	}
+	n := binary.LittleEndian.Uint32(bs[40:44])
+	want := uint64(HEADER_LEN) + uint64(n)
+	if p.Flags&FLAG_CRC != 0 {
+		want += CRC_LEN
+	}
+	if uint64(len(bs)) != want {
+		return nil, fmt.Errorf("%w: %d bytes, header says %d", ErrLength, len(bs), want)
+	}
+	if p.Flags&FLAG_CRC != 0 {
+		end := len(bs) - CRC_LEN
+		if crc32.Checksum(bs[:end], castagnoli) != binary.LittleEndian.Uint32(bs[end:]) {
+			return nil, ErrChecksum
+		}
+	}
+	p.Payload = bs[HEADER_LEN : HEADER_LEN+int(n)]
+	return p, nil
+}
+
+/**
+ * Stamp puts the server timestamps into an encoded packet in place, bs must have passed Decode
+ */
+func Stamp(bs []byte, recv int64, send int64) {
+	flags := binary.LittleEndian.Uint16(bs[4:6]) | FLAG_STAMPED
+	binary.LittleEndian.PutUint16(bs[4:6], flags)
+	binary.LittleEndian.PutUint64(bs[24:32], uint64(recv))
+	binary.LittleEndian.PutUint64(bs[32:40], uint64(send))
+	sum(bs, flags)
+}
+
+func sum(bs []byte, flags uint16) {
+	if flags&FLAG_CRC == 0 {
+		return
+	}
+	end := len(bs) - CRC_LEN
+	binary.LittleEndian.PutUint32(bs[end:], crc32.Checksum(bs[:end], castagnoli))
+}
@@ -0,0 +1,92 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		p    Packet
+	}{
+		{"empty pingpong", Packet{Type: TYPE_PINGPONG, Seq: 1, ClientSend: 1000}},
+		{"payload", Packet{Type: TYPE_PINGPONG, Seq: 2, ClientSend: 2000, Payload: []byte("hello")}},
+		{"crc", Packet{Type: TYPE_PINGPONG, Flags: FLAG_CRC, Seq: 3, ClientSend: 3000, Payload: []byte{1, 2, 3}}},
+		{"stamped", Packet{Type: TYPE_PINGPONG, Flags: FLAG_STAMPED, Seq: 4, ClientSend: 1, ServerRecv: 2, ServerSend: 3}},
+		{"bulk", Packet{Type: TYPE_BULK, Seq: 5, Payload: make([]byte, 1<<16)}},
+		{"max seq", Packet{Type: TYPE_PINGPONG, Flags: FLAG_CRC, Seq: ^uint64(0), ClientSend: -1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bs := c.p.Encode()
+			if len(bs) != c.p.Len() {
+				t.Fatalf("encoded %d bytes, Len says %d", len(bs), c.p.Len())
+			}
+			got, err := Decode(bs)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got.Type != c.p.Type || got.Flags != c.p.Flags || got.Seq != c.p.Seq ||
+				got.ClientSend != c.p.ClientSend || got.ServerRecv != c.p.ServerRecv || got.ServerSend != c.p.ServerSend {
+				t.Fatalf("decoded %+v, want %+v", got, c.p)
+			}
+			if !bytes.Equal(got.Payload, c.p.Payload) {
+				t.Fatalf("payload of %d bytes, want %d", len(got.Payload), len(c.p.Payload))
+			}
+		})
+	}
+}
+
+func TestStamp(t *testing.T) {
+	for _, flags := range []uint16{0, FLAG_CRC} {
+		p := Packet{Type: TYPE_PINGPONG, Flags: flags, Seq: 7, ClientSend: 100, Payload: []byte("x")}
+		bs := p.Encode()
+		Stamp(bs, 200, 300)
+		got, err := Decode(bs)
+		if err != nil {
+			t.Fatalf("flags %#x: decode after stamp: %v", flags, err)
+		}
+		if !got.Stamped() || got.ServerRecv != 200 || got.ServerSend != 300 || got.ClientSend != 100 {
+			t.Fatalf("flags %#x: stamped packet %+v", flags, got)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	valid := func() []byte {
+		p := Packet{Type: TYPE_PINGPONG, Flags: FLAG_CRC, Seq: 1, Payload: []byte("payload")}
+		return p.Encode()
+	}
+	cases := []struct {
+		name   string
+		mangle func(bs []byte) []byte
+		want   error
+	}{
+		{"empty", func(bs []byte) []byte { return nil }, ErrShort},
+		{"truncated header", func(bs []byte) []byte { return bs[:HEADER_LEN-1] }, ErrShort},
+		{"bad magic", func(bs []byte) []byte { bs[0] = 'X'; return bs }, ErrMagic},
+		{"bad version", func(bs []byte) []byte { bs[2] = VERSION + 1; return bs }, ErrVersion},
+		{"unknown type", func(bs []byte) []byte { bs[3] = 9; return bs }, ErrType},
+		{"unknown flags", func(bs []byte) []byte { bs[4] |= 0x80; return bs }, ErrFlags},
+		{"truncated payload", func(bs []byte) []byte { return bs[:len(bs)-1] }, ErrLength},
+		{"trailing bytes", func(bs []byte) []byte { return append(bs, 0) }, ErrLength},
+		{"length past the end", func(bs []byte) []byte {
+			binary.LittleEndian.PutUint32(bs[40:44], 0xffffffff)
+			return bs
+		}, ErrLength},
+		{"bad crc", func(bs []byte) []byte { bs[len(bs)-1] ^= 0xff; return bs }, ErrChecksum},
+		{"corrupt payload", func(bs []byte) []byte { bs[HEADER_LEN] ^= 0xff; return bs }, ErrChecksum},
+		{"corrupt seq", func(bs []byte) []byte { bs[8] ^= 0x01; return bs }, ErrChecksum},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Decode(c.mangle(valid()))
+			if !errors.Is(err, c.want) {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
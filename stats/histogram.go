@@ -0,0 +1,195 @@
+package stats
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// values below LINEAR_BUCKETS get a bucket each, above that every power of two is split into
+// LINEAR_BUCKETS / 2 buckets, so a recorded value is off by at most 1 / 1024 (3 significant digits)
+const SUB_BUCKET_BITS = 11
+const LINEAR_BUCKETS = 1 << SUB_BUCKET_BITS
+const HALF_BUCKETS = LINEAR_BUCKETS / 2
+
+/**
+ * Histogram is an HDR-style log-linear histogram of durations: a fixed relative precision over
+ * the whole range, with memory growing with the log of the largest value only.
+ * Min, max, mean and stddev are exact. It is not safe for concurrent use, see Recorder.
+ */
+type Histogram struct {
+	counts []uint64
+	count  uint64
+	min    int64
+	max    int64
+	// running mean and sum of squared deviations (Welford), in nano seconds
+	mean float64
+	m2   float64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+func bucketOf(v int64) int {
+	if v < LINEAR_BUCKETS {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - SUB_BUCKET_BITS
+	return LINEAR_BUCKETS + (shift-1)*HALF_BUCKETS + int(v>>shift) - HALF_BUCKETS
+}
+
+/**
+ * valueOf returns the middle of the range of values counted in a bucket
+ */
+func valueOf(idx int) int64 {
+	if idx < LINEAR_BUCKETS {
+		return int64(idx)
+	}
+	shift := (idx-LINEAR_BUCKETS)/HALF_BUCKETS + 1
+	m := int64((idx-LINEAR_BUCKETS)%HALF_BUCKETS + HALF_BUCKETS)
+	return m<<shift + (int64(1)<<shift)/2
+}
+
+/**
+ * Record adds a sample, negative samples count as 0
+ */
+func (h *Histogram) Record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	idx := bucketOf(v)
+	if idx >= len(h.counts) {
+		grown := make([]uint64, idx+1)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	h.counts[idx]++
+
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	delta := float64(v) - h.mean
+	h.mean += delta / float64(h.count)
+	h.m2 += delta * (float64(v) - h.mean)
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+func (h *Histogram) Min() time.Duration {
+	return time.Duration(h.min)
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
+
+func (h *Histogram) Mean() time.Duration {
+	return time.Duration(h.mean)
+}
+
+/**
+ * StdDev returns the population standard deviation of the samples
+ */
+func (h *Histogram) StdDev() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(h.m2 / float64(h.count)))
+}
+
+/**
+ * Percentile returns the value below which p percent of the samples fall, p in [0, 100]
+ */
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	if p <= 0 {
+		return h.Min()
+	}
+	if p >= 100 {
+		return h.Max()
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(h.count)))
+	seen := uint64(0)
+	for idx, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			// the bucket middle may lie outside the samples actually seen
+			v := valueOf(idx)
+			if v < h.min {
+				v = h.min
+			}
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return h.Max()
+}
+
+/**
+ * Merge adds the samples of o to h
+ */
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		grown := make([]uint64, len(o.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for idx, n := range o.counts {
+		h.counts[idx] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	// parallel variant of Welford
+	n := float64(h.count + o.count)
+	delta := o.mean - h.mean
+	h.m2 += o.m2 + delta*delta*float64(h.count)*float64(o.count)/n
+	h.mean += delta * float64(o.count) / n
+	h.count += o.count
+}
+
+/**
+ * Reset drops every sample but keeps the buckets allocated
+ */
+func (h *Histogram) Reset() {
+	counts := h.counts
+	for i := range counts {
+		counts[i] = 0
+	}
+	*h = Histogram{counts: counts}
+}
+
+/**
+ * Summary takes the usual figures of the distribution
+ */
+func (h *Histogram) Summary() Summary {
+	return Summary{
+		Count:  h.count,
+		Min:    h.Min(),
+		P50:    h.Percentile(50),
+		P90:    h.Percentile(90),
+		P99:    h.Percentile(99),
+		P999:   h.Percentile(99.9),
+		Max:    h.Max(),
+		Mean:   h.Mean(),
+		StdDev: h.StdDev(),
+	}
+}
@@ -0,0 +1,122 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketBoundaries(t *testing.T) {
+	cases := []struct {
+		v   int64
+		idx int
+	}{
+		{0, 0},
+		{1, 1},
+		{LINEAR_BUCKETS - 1, LINEAR_BUCKETS - 1},
+		// first log bucket, two values wide
+		{LINEAR_BUCKETS, LINEAR_BUCKETS},
+		{LINEAR_BUCKETS + 1, LINEAR_BUCKETS},
+		{LINEAR_BUCKETS + 2, LINEAR_BUCKETS + 1},
+		{2*LINEAR_BUCKETS - 1, LINEAR_BUCKETS + HALF_BUCKETS - 1},
+		// next power of two, four values wide
+		{2 * LINEAR_BUCKETS, LINEAR_BUCKETS + HALF_BUCKETS},
+		{2*LINEAR_BUCKETS + 3, LINEAR_BUCKETS + HALF_BUCKETS},
+		{2*LINEAR_BUCKETS + 4, LINEAR_BUCKETS + HALF_BUCKETS + 1},
+		{4*LINEAR_BUCKETS - 1, LINEAR_BUCKETS + 2*HALF_BUCKETS - 1},
+		{4 * LINEAR_BUCKETS, LINEAR_BUCKETS + 2*HALF_BUCKETS},
+	}
+	for _, c := range cases {
+		if idx := bucketOf(c.v); idx != c.idx {
+			t.Errorf("bucketOf(%d) = %d, want %d", c.v, idx, c.idx)
+		}
+	}
+}
+
+func TestBucketPrecision(t *testing.T) {
+	values := []int64{}
+	for shift := SUB_BUCKET_BITS; shift < 40; shift++ {
+		edge := int64(1) << shift
+		values = append(values, edge-1, edge, edge+1, edge+edge/2)
+	}
+	values = append(values, int64(time.Hour), 1<<62)
+	for _, v := range values {
+		got := valueOf(bucketOf(v))
+		diff := got - v
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff*HALF_BUCKETS > v {
+			t.Errorf("valueOf(bucketOf(%d)) = %d, off by more than 1/%d", v, got, HALF_BUCKETS)
+		}
+	}
+	// below LINEAR_BUCKETS every value is exact
+	for v := int64(0); v < LINEAR_BUCKETS; v++ {
+		if got := valueOf(bucketOf(v)); got != v {
+			t.Fatalf("valueOf(bucketOf(%d)) = %d", v, got)
+		}
+	}
+	// buckets are contiguous across the sub-bucket edges
+	for v := int64(LINEAR_BUCKETS - 2); v < 8*LINEAR_BUCKETS; v++ {
+		if d := bucketOf(v+1) - bucketOf(v); d != 0 && d != 1 {
+			t.Fatalf("bucketOf jumps by %d between %d and %d", d, v, v+1)
+		}
+	}
+}
+
+func TestPercentileBounds(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []int64
+		p       float64
+		want    int64
+	}{
+		{"empty", nil, 50, 0},
+		{"p0 is min", []int64{5000, 7000}, 0, 5000},
+		{"p100 is max", []int64{5000, 7000}, 100, 7000},
+		{"exact below the edge", []int64{LINEAR_BUCKETS - 1, LINEAR_BUCKETS}, 50, LINEAR_BUCKETS - 1},
+		// the bucket of 2048 has its middle at 2049, clamped to the max
+		{"clamped to max at the edge", []int64{LINEAR_BUCKETS - 1, LINEAR_BUCKETS}, 99, LINEAR_BUCKETS},
+		// the bucket of 4097 has its middle at 4098, clamped to the single sample
+		{"single sample", []int64{2*LINEAR_BUCKETS + 1}, 50, 2*LINEAR_BUCKETS + 1},
+		// 4099 is the top of the bucket [4096, 4099], its middle 4098 is clamped to the min
+		{"clamped to min", []int64{2*LINEAR_BUCKETS + 3, 3 * LINEAR_BUCKETS}, 1, 2*LINEAR_BUCKETS + 3},
+		{"linear range", []int64{10, 20, 30, 40}, 50, 20},
+		{"rank rounds up", []int64{10, 20, 30, 40}, 51, 30},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := NewHistogram()
+			for _, v := range c.samples {
+				h.Record(time.Duration(v))
+			}
+			if got := h.Percentile(c.p); got != time.Duration(c.want) {
+				t.Fatalf("p%v = %d, want %d", c.p, got, c.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := NewHistogram(), NewHistogram(), NewHistogram()
+	for v := int64(1); v <= 10000; v += 7 {
+		d := time.Duration(v * 1000)
+		if v%2 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+		all.Record(d)
+	}
+	a.Merge(b)
+	if a.Count() != all.Count() || a.Min() != all.Min() || a.Max() != all.Max() {
+		t.Fatalf("merged %d [%v, %v], want %d [%v, %v]", a.Count(), a.Min(), a.Max(), all.Count(), all.Min(), all.Max())
+	}
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		if a.Percentile(p) != all.Percentile(p) {
+			t.Errorf("merged p%v = %v, want %v", p, a.Percentile(p), all.Percentile(p))
+		}
+	}
+	if diff := a.StdDev() - all.StdDev(); diff < -time.Microsecond || diff > time.Microsecond {
+		t.Errorf("merged stddev = %v, want %v", a.StdDev(), all.StdDev())
+	}
+}
@@ -0,0 +1,85 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// gain of the smoothed jitter, 1/16 as in RFC 3550
+const JITTER_GAIN = 16
+
+/**
+ * Jitter measures the variation of the transit time of a flow in arrival order: the smoothed
+ * interarrival jitter of RFC 3550 (A.8) and the distribution of the delta between consecutive
+ * transit times. For a pingpong the transit time is the round trip, so no clock sync is needed.
+ * It is safe for concurrent use.
+ */
+type Jitter struct {
+	mu   sync.Mutex
+	last time.Duration
+	has  bool
+	// smoothed jitter in nano seconds
+	smoothed float64
+	// absolute delta between consecutive transit times
+	delta *Recorder
+}
+
+func NewJitter() *Jitter {
+	return &Jitter{delta: NewRecorder()}
+}
+
+/**
+ * Record adds the transit time of the next packet to arrive
+ */
+func (j *Jitter) Record(transit time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.has {
+		j.last = transit
+		j.has = true
+		return
+	}
+	d := transit - j.last
+	j.last = transit
+	if d < 0 {
+		d = -d
+	}
+	j.smoothed += (float64(d) - j.smoothed) / JITTER_GAIN
+	j.delta.Record(d)
+}
+
+/**
+ * Smoothed returns the current RFC 3550 jitter
+ */
+func (j *Jitter) Smoothed() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return time.Duration(j.smoothed)
+}
+
+/**
+ * Interval reports the deltas since the previous call and starts a new interval
+ */
+func (j *Jitter) Interval() JitterReport {
+	return JitterReport{Smoothed: j.Smoothed(), Delta: j.delta.Interval()}
+}
+
+/**
+ * Total reports the deltas of the whole run
+ */
+func (j *Jitter) Total() JitterReport {
+	return JitterReport{Smoothed: j.Smoothed(), Delta: j.delta.Total()}
+}
+
+/**
+ * JitterReport is a snapshot of a Jitter, Delta is the distribution of the consecutive deltas
+ */
+type JitterReport struct {
+	Smoothed time.Duration
+	Delta    Summary
+}
+
+func (r JitterReport) String() string {
+	return fmt.Sprintf("rfc3550 = %.1f us, delta %s", us(r.Smoothed), r.Delta)
+}
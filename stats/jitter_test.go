@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	cases := []struct {
+		name     string
+		transits []time.Duration
+		smoothed time.Duration
+		deltas   uint64
+		maxDelta time.Duration
+	}{
+		{"empty", nil, 0, 0, 0},
+		{"single packet", []time.Duration{100}, 0, 0, 0},
+		{"constant transit", []time.Duration{500, 500, 500, 500}, 0, 3, 0},
+		{"one step", []time.Duration{100, 1700}, 100, 1, 1600},
+		{"one step down", []time.Duration{1700, 100}, 100, 1, 1600},
+		// 100, then 100 + (1600 - 100) / 16
+		{"two steps", []time.Duration{0, 1600, 0}, 193, 2, 1600},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			j := NewJitter()
+			for _, transit := range c.transits {
+				j.Record(transit)
+			}
+			r := j.Total()
+			if r.Smoothed != c.smoothed {
+				t.Errorf("smoothed = %v, want %v", r.Smoothed, c.smoothed)
+			}
+			if r.Delta.Count != c.deltas || r.Delta.Max != c.maxDelta {
+				t.Errorf("delta n = %d, max = %v, want n = %d, max = %v", r.Delta.Count, r.Delta.Max, c.deltas, c.maxDelta)
+			}
+		})
+	}
+}
+
+func TestJitterInterval(t *testing.T) {
+	j := NewJitter()
+	j.Record(100)
+	j.Record(200)
+	if r := j.Interval(); r.Delta.Count != 1 {
+		t.Fatalf("first interval has %d deltas, want 1", r.Delta.Count)
+	}
+	j.Record(200)
+	r := j.Interval()
+	if r.Delta.Count != 1 || r.Delta.Max != 0 {
+		t.Fatalf("second interval n = %d, max = %v, want 1 delta of 0", r.Delta.Count, r.Delta.Max)
+	}
+	if total := j.Total(); total.Delta.Count != 2 {
+		t.Fatalf("total has %d deltas, want 2", total.Delta.Count)
+	}
+}
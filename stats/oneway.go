@@ -0,0 +1,124 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// samples the clock offset is filtered over, the one of the least round trip delay is taken as in the NTP clock filter
+const OFFSET_WINDOW = 64
+
+type offsetSample struct {
+	offset time.Duration
+	delay  time.Duration
+}
+
+/**
+ * OneWay splits the round trips of a flow into uplink, server processing and downlink from the
+ * four NTP timestamps of every packet. The offset of the server clock is estimated NTP-style over the
+ * session: every packet gives an offset, valid to within half its round trip delay, the packet of the
+ * least delay among the last OFFSET_WINDOW gives the estimate. An asymmetric path biases the offset
+ * by half the asymmetry, which no timestamp exchange can tell apart. It is safe for concurrent use.
+ */
+type OneWay struct {
+	mu     sync.Mutex
+	window []offsetSample
+	next   int
+	best   offsetSample
+
+	uplink     *Recorder
+	downlink   *Recorder
+	processing *Recorder
+}
+
+func NewOneWay() *OneWay {
+	return &OneWay{
+		window:     make([]offsetSample, 0, OFFSET_WINDOW),
+		uplink:     NewRecorder(),
+		downlink:   NewRecorder(),
+		processing: NewRecorder(),
+	}
+}
+
+/**
+ * Record adds a packet by its timestamps in ns: client send, server receive, server send and client receive
+ */
+func (o *OneWay) Record(t1, t2, t3, t4 int64) {
+	s := offsetSample{
+		offset: time.Duration(((t2 - t1) + (t3 - t4)) / 2),
+		delay:  time.Duration((t4 - t1) - (t3 - t2)),
+	}
+	o.mu.Lock()
+	if len(o.window) < OFFSET_WINDOW {
+		o.window = append(o.window, s)
+	} else {
+		o.window[o.next] = s
+		o.next = (o.next + 1) % OFFSET_WINDOW
+	}
+	o.best = o.window[0]
+	for _, w := range o.window[1:] {
+		if w.delay < o.best.delay {
+			o.best = w
+		}
+	}
+	offset := int64(o.best.offset)
+	o.mu.Unlock()
+
+	// one way delays below 0 are estimation errors, recorded as 0
+	o.uplink.Record(time.Duration(t2 - t1 - offset))
+	o.downlink.Record(time.Duration(t4 - t3 + offset))
+	o.processing.Record(time.Duration(t3 - t2))
+}
+
+/**
+ * Offset returns the estimated server clock minus the client clock, and the delay of the sample it is taken from
+ */
+func (o *OneWay) Offset() (time.Duration, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.best.offset, o.best.delay
+}
+
+/**
+ * Interval reports the packets since the previous call and starts a new interval
+ */
+func (o *OneWay) Interval() OneWayReport {
+	offset, delay := o.Offset()
+	return OneWayReport{
+		Offset:     offset,
+		Delay:      delay,
+		Uplink:     o.uplink.Interval(),
+		Downlink:   o.downlink.Interval(),
+		Processing: o.processing.Interval(),
+	}
+}
+
+/**
+ * Total reports the packets of the whole run, with the latest offset
+ */
+func (o *OneWay) Total() OneWayReport {
+	offset, delay := o.Offset()
+	return OneWayReport{
+		Offset:     offset,
+		Delay:      delay,
+		Uplink:     o.uplink.Total(),
+		Downlink:   o.downlink.Total(),
+		Processing: o.processing.Total(),
+	}
+}
+
+/**
+ * OneWayReport is a snapshot of a OneWay, Delay is the round trip less the server processing of the offset sample
+ */
+type OneWayReport struct {
+	Offset     time.Duration
+	Delay      time.Duration
+	Uplink     Summary
+	Downlink   Summary
+	Processing Summary
+}
+
+func (r OneWayReport) OffsetString() string {
+	return fmt.Sprintf("%.1f us (+- %.1f us)", us(r.Offset), us(r.Delay)/2)
+}
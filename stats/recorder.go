@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * Recorder keeps the histogram of a whole run and of the current interval, safe for concurrent use
+ */
+type Recorder struct {
+	mu       sync.Mutex
+	total    *Histogram
+	interval *Histogram
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		total:    NewHistogram(),
+		interval: NewHistogram(),
+	}
+}
+
+func (r *Recorder) Record(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total.Record(d)
+	r.interval.Record(d)
+}
+
+/**
+ * Interval summarizes the samples since the previous call and starts a new interval
+ */
+func (r *Recorder) Interval() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.interval.Summary()
+	r.interval.Reset()
+	return s
+}
+
+/**
+ * Total summarizes every sample of the run
+ */
+func (r *Recorder) Total() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total.Summary()
+}
@@ -0,0 +1,206 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DEFAULT_LOSS_DEADLINE = time.Second
+
+// a packet declared lost is remembered that many deadlines long, arriving later still it counts as a duplicate
+const LATE_HORIZON = 10
+
+// what a received sequence number turned out to be
+const (
+	SEQ_IN_ORDER = iota
+	SEQ_REORDERED
+	SEQ_LATE
+	SEQ_DUPLICATE
+	SEQ_UNKNOWN
+)
+
+var seqOutcomeNames = []string{"in order", "reordered", "late", "duplicate", "unknown"}
+
+func SeqOutcomeName(outcome int) string {
+	if outcome < 0 || outcome >= len(seqOutcomeNames) {
+		return "invalid"
+	}
+	return seqOutcomeNames[outcome]
+}
+
+/**
+ * SeqTracker classifies the packets of a flow by their sequence numbers. The sender registers every
+ * number before sending it, a number not received within the loss deadline is lost, one received after
+ * that is late instead. A number received below the highest received so far is reordered, one received
+ * again is a duplicate. It is safe for concurrent use.
+ */
+type SeqTracker struct {
+	// JoinLate counts from the first received packet on, dropping what was sent before it,
+	// for a receiver that joins a running flow such as a multicast responder
+	JoinLate bool
+
+	mu       sync.Mutex
+	deadline time.Duration
+	pending  map[uint64]time.Time
+	lost     map[uint64]time.Time
+	maxSent  uint64
+	highest  uint64
+	started  bool
+	// expire runs at most every deadline / 10, Recv checks the deadline of its own packet
+	expiredAt time.Time
+
+	sent      uint64
+	received  uint64
+	lostN     uint64
+	late      uint64
+	reordered uint64
+	duplicate uint64
+}
+
+func NewSeqTracker(deadline time.Duration) *SeqTracker {
+	if deadline <= 0 {
+		deadline = DEFAULT_LOSS_DEADLINE
+	}
+	return &SeqTracker{
+		deadline: deadline,
+		pending:  make(map[uint64]time.Time),
+		lost:     make(map[uint64]time.Time),
+	}
+}
+
+/**
+ * Sent registers a sequence number, before the packet is handed to the transport
+ */
+func (t *SeqTracker) Sent(seq uint64, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[seq] = at
+	t.sent++
+	if seq > t.maxSent {
+		t.maxSent = seq
+	}
+}
+
+/**
+ * Recv classifies a received sequence number, as one of the SEQ_ outcomes
+ */
+func (t *SeqTracker) Recv(seq uint64, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+
+	if !t.started && t.JoinLate {
+		for s := range t.pending {
+			if s < seq {
+				delete(t.pending, s)
+				t.sent--
+			}
+		}
+		for s := range t.lost {
+			if s < seq {
+				delete(t.lost, s)
+				t.lostN--
+				t.sent--
+			}
+		}
+	}
+	if at, ok := t.pending[seq]; ok {
+		delete(t.pending, seq)
+		return t.arrived(seq, now.Sub(at) > t.deadline)
+	}
+	if _, ok := t.lost[seq]; ok {
+		delete(t.lost, seq)
+		t.lostN--
+		return t.arrived(seq, true)
+	}
+	if t.started && seq <= t.maxSent {
+		t.duplicate++
+		return SEQ_DUPLICATE
+	}
+	return SEQ_UNKNOWN
+}
+
+/**
+ * arrived counts the first arrival of a sequence number, a late one is not counted as reordered too
+ */
+func (t *SeqTracker) arrived(seq uint64, late bool) int {
+	t.received++
+	reordered := t.started && seq < t.highest
+	if !reordered {
+		t.started = true
+		t.highest = seq
+	}
+	switch {
+	case late:
+		t.late++
+		return SEQ_LATE
+	case reordered:
+		t.reordered++
+		return SEQ_REORDERED
+	}
+	return SEQ_IN_ORDER
+}
+
+/**
+ * expire declares lost what is pending for longer than the deadline
+ */
+func (t *SeqTracker) expire(now time.Time) {
+	if now.Sub(t.expiredAt) < t.deadline/10 {
+		return
+	}
+	t.expiredAt = now
+	for seq, at := range t.pending {
+		if now.Sub(at) > t.deadline {
+			delete(t.pending, seq)
+			t.lost[seq] = at
+			t.lostN++
+		}
+	}
+	for seq, at := range t.lost {
+		if now.Sub(at) > LATE_HORIZON*t.deadline {
+			delete(t.lost, seq)
+		}
+	}
+}
+
+/**
+ * Report counts the packets so far, what is still within the deadline is in flight
+ */
+func (t *SeqTracker) Report(now time.Time) SeqReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expiredAt = time.Time{}
+	t.expire(now)
+	return SeqReport{
+		Sent:      t.sent,
+		Received:  t.received,
+		Lost:      t.lostN,
+		Late:      t.late,
+		Reordered: t.reordered,
+		Duplicate: t.duplicate,
+		InFlight:  uint64(len(t.pending)),
+	}
+}
+
+/**
+ * SeqReport is a snapshot of a SeqTracker, Received includes the late packets
+ */
+type SeqReport struct {
+	Sent      uint64
+	Received  uint64
+	Lost      uint64
+	Late      uint64
+	Reordered uint64
+	Duplicate uint64
+	InFlight  uint64
+}
+
+func (r SeqReport) String() string {
+	rate := 0.0
+	if r.Sent > r.InFlight {
+		rate = float64(r.Lost) * 100 / float64(r.Sent-r.InFlight)
+	}
+	return fmt.Sprintf("sent = %d, received = %d, lost = %d (%.2f%%), late = %d, reordered = %d, duplicate = %d, in flight = %d",
+		r.Sent, r.Received, r.Lost, rate, r.Late, r.Reordered, r.Duplicate, r.InFlight)
+}
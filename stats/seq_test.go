@@ -0,0 +1,156 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+const testDeadline = 100 * time.Millisecond
+
+type seqStep struct {
+	// 's' for Sent, 'r' for Recv, checked against outcome, 'p' for a Report in between
+	op      byte
+	seq     uint64
+	at      time.Duration
+	outcome int
+}
+
+func TestSeqTracker(t *testing.T) {
+	cases := []struct {
+		name     string
+		joinLate bool
+		steps    []seqStep
+		reportAt time.Duration
+		want     SeqReport
+	}{
+		{
+			name: "in order",
+			steps: []seqStep{
+				{'s', 1, 0, 0}, {'s', 2, 0, 0},
+				{'r', 1, 10 * time.Millisecond, SEQ_IN_ORDER}, {'r', 2, 10 * time.Millisecond, SEQ_IN_ORDER},
+			},
+			reportAt: 20 * time.Millisecond,
+			want:     SeqReport{Sent: 2, Received: 2},
+		},
+		{
+			name: "reordered",
+			steps: []seqStep{
+				{'s', 1, 0, 0}, {'s', 2, 0, 0}, {'s', 3, 0, 0},
+				{'r', 1, time.Millisecond, SEQ_IN_ORDER}, {'r', 3, time.Millisecond, SEQ_IN_ORDER},
+				{'r', 2, 2 * time.Millisecond, SEQ_REORDERED},
+			},
+			reportAt: 3 * time.Millisecond,
+			want:     SeqReport{Sent: 3, Received: 3, Reordered: 1},
+		},
+		{
+			name: "duplicate",
+			steps: []seqStep{
+				{'s', 1, 0, 0},
+				{'r', 1, time.Millisecond, SEQ_IN_ORDER}, {'r', 1, 2 * time.Millisecond, SEQ_DUPLICATE},
+			},
+			reportAt: 3 * time.Millisecond,
+			want:     SeqReport{Sent: 1, Received: 1, Duplicate: 1},
+		},
+		{
+			name: "unknown",
+			steps: []seqStep{
+				{'r', 5, 0, SEQ_UNKNOWN},
+				{'s', 1, 0, 0}, {'r', 1, time.Millisecond, SEQ_IN_ORDER},
+				{'r', 9, 2 * time.Millisecond, SEQ_UNKNOWN},
+			},
+			reportAt: 3 * time.Millisecond,
+			want:     SeqReport{Sent: 1, Received: 1},
+		},
+		{
+			name:     "in flight before the deadline",
+			steps:    []seqStep{{'s', 1, 0, 0}},
+			reportAt: testDeadline,
+			want:     SeqReport{Sent: 1, InFlight: 1},
+		},
+		{
+			name:     "lost past the deadline",
+			steps:    []seqStep{{'s', 1, 0, 0}},
+			reportAt: testDeadline + time.Millisecond,
+			want:     SeqReport{Sent: 1, Lost: 1},
+		},
+		{
+			name:     "received at the deadline",
+			steps:    []seqStep{{'s', 1, 0, 0}, {'r', 1, testDeadline, SEQ_IN_ORDER}},
+			reportAt: testDeadline,
+			want:     SeqReport{Sent: 1, Received: 1},
+		},
+		{
+			name:     "late past the deadline",
+			steps:    []seqStep{{'s', 1, 0, 0}, {'r', 1, testDeadline + time.Millisecond, SEQ_LATE}},
+			reportAt: 2 * testDeadline,
+			want:     SeqReport{Sent: 1, Received: 1, Late: 1},
+		},
+		{
+			name: "late after being reported lost",
+			steps: []seqStep{
+				{'s', 1, 0, 0},
+				{'p', 0, 2 * testDeadline, 0},
+				{'r', 1, 3 * testDeadline, SEQ_LATE},
+			},
+			reportAt: 3 * testDeadline,
+			want:     SeqReport{Sent: 1, Received: 1, Late: 1},
+		},
+		{
+			name: "late is not reordered too",
+			steps: []seqStep{
+				{'s', 1, 0, 0}, {'s', 2, 0, 0},
+				{'r', 2, time.Millisecond, SEQ_IN_ORDER},
+				{'r', 1, 2 * testDeadline, SEQ_LATE},
+			},
+			reportAt: 2 * testDeadline,
+			want:     SeqReport{Sent: 2, Received: 2, Late: 1},
+		},
+		{
+			name: "duplicate past the late horizon",
+			steps: []seqStep{
+				{'s', 1, 0, 0}, {'s', 2, 0, 0},
+				{'r', 2, time.Millisecond, SEQ_IN_ORDER},
+				{'p', 0, 2 * testDeadline, 0},
+				{'p', 0, (LATE_HORIZON + 2) * testDeadline, 0},
+				{'r', 1, (LATE_HORIZON + 2) * testDeadline, SEQ_DUPLICATE},
+			},
+			reportAt: (LATE_HORIZON + 2) * testDeadline,
+			want:     SeqReport{Sent: 2, Received: 1, Lost: 1, Duplicate: 1},
+		},
+		{
+			name:     "join late",
+			joinLate: true,
+			steps: []seqStep{
+				{'s', 1, 0, 0}, {'s', 2, 0, 0}, {'s', 3, 0, 0},
+				{'p', 0, 2 * testDeadline, 0},
+				{'s', 4, 2 * testDeadline, 0},
+				{'r', 4, 2*testDeadline + time.Millisecond, SEQ_IN_ORDER},
+			},
+			reportAt: 2*testDeadline + time.Millisecond,
+			want:     SeqReport{Sent: 1, Received: 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start := time.Now()
+			tr := NewSeqTracker(testDeadline)
+			tr.JoinLate = c.joinLate
+			for i, s := range c.steps {
+				at := start.Add(s.at)
+				switch s.op {
+				case 's':
+					tr.Sent(s.seq, at)
+				case 'r':
+					if got := tr.Recv(s.seq, at); got != s.outcome {
+						t.Fatalf("step %d: recv %d is %s, want %s", i, s.seq, SeqOutcomeName(got), SeqOutcomeName(s.outcome))
+					}
+				case 'p':
+					tr.Report(at)
+				}
+			}
+			if got := tr.Report(start.Add(c.reportAt)); got != c.want {
+				t.Fatalf("report %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
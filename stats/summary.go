@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+/**
+ * Summary is a snapshot of a latency distribution
+ */
+type Summary struct {
+	Count  uint64
+	Min    time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	P999   time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func us(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+/**
+ * String formats the summary in micro seconds
+ */
+func (s Summary) String() string {
+	if s.Count == 0 {
+		return "n = 0"
+	}
+	return fmt.Sprintf("n = %d, min = %.1f us, p50 = %.1f us, p90 = %.1f us, p99 = %.1f us, p99.9 = %.1f us, max = %.1f us, avg = %.1f us, stddev = %.1f us",
+		s.Count, us(s.Min), us(s.P50), us(s.P90), us(s.P99), us(s.P999), us(s.Max), us(s.Mean), us(s.StdDev))
+}